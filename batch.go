@@ -0,0 +1,236 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+// DefaultBatchSize is the number of rows in a batch of a BatchInserter,
+// unless another size is given.
+const DefaultBatchSize = 1000
+
+// BatchResult is the result of one INSERT statement of a BatchInserter.
+type BatchResult struct {
+	// Rows is the number of rows that the statement inserted.
+	Rows int64
+
+	// Err is the error of the statement, if it failed.
+	Err error
+}
+
+// BatchInserter inserts rows into a table in batches, with an INSERT
+// statement for many rows at once instead of a round trip for each row.
+// The batches are inserted in a transaction on the connection, which is
+// started with the first batch and ended by Commit or Rollback.
+//
+//	b := monetdb.NewBatchInserter(conn, "t", []string{"a", "b"}, 0)
+//	for _, r := range records {
+//		if err := b.Insert(ctx, r.A, r.B); err != nil {
+//			return err
+//		}
+//	}
+//	return b.Commit(ctx)
+//
+// A statement is also sent when it would not fit in a single MAPI
+// block, so that it is sent with a single write.
+//
+// When a batch fails, the transaction is rolled back and the inserter
+// can't be used any more.
+type BatchInserter struct {
+	conn      *sql.Conn
+	tx        *sql.Tx
+	insert    string
+	columns   int
+	batchSize int
+
+	// values holds the rows of the batch, rendered as (v1, v2, ...)
+	values  strings.Builder
+	rows    int
+	results []BatchResult
+	err     error
+}
+
+// NewBatchInserter returns a BatchInserter for the given columns of a
+// table, which may be given as schema.table. All columns are inserted
+// when columns is empty. A batchSize of zero means DefaultBatchSize.
+func NewBatchInserter(conn *sql.Conn, table string, columns []string, batchSize int) *BatchInserter {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	var b strings.Builder
+	b.WriteString("INSERT INTO ")
+	b.WriteString(quoteTable(table))
+	if len(columns) > 0 {
+		names := make([]string, len(columns))
+		for i, c := range columns {
+			names[i] = quoteIdentifier(c)
+		}
+		fmt.Fprintf(&b, " (%s)", strings.Join(names, ", "))
+	}
+	b.WriteString(" VALUES ")
+
+	return &BatchInserter{
+		conn:      conn,
+		insert:    b.String(),
+		columns:   len(columns),
+		batchSize: batchSize,
+	}
+}
+
+// Insert adds a row to the batch, and inserts the batch when it is full.
+// The values are of the types that a query accepts as arguments.
+func (b *BatchInserter) Insert(ctx context.Context, values ...driver.Value) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.columns > 0 && len(values) != b.columns {
+		return fmt.Errorf("Invalid number of values: %d, expected: %d", len(values), b.columns)
+	}
+
+	var row strings.Builder
+	row.WriteByte('(')
+	for i, v := range values {
+		s, err := convertToMonet(v)
+		if err != nil {
+			return fmt.Errorf("Column %d: %v", i+1, err)
+		}
+		if i > 0 {
+			row.WriteString(", ")
+		}
+		row.WriteString(s)
+	}
+	row.WriteByte(')')
+
+	// the statement is sent as s<insert><values>;
+	size := len(b.insert) + b.values.Len() + len(", ") + row.Len() + len("s;")
+	if b.rows > 0 && size > mapi_MAX_PACKAGE_LENGTH {
+		if err := b.Flush(ctx); err != nil {
+			return err
+		}
+	}
+
+	if b.rows > 0 {
+		b.values.WriteString(", ")
+	}
+	b.values.WriteString(row.String())
+	b.rows++
+
+	if b.rows >= b.batchSize {
+		return b.Flush(ctx)
+	}
+	return nil
+}
+
+// Flush inserts the rows of the batch, without waiting for it to be full.
+func (b *BatchInserter) Flush(ctx context.Context) error {
+	if b.err != nil {
+		return b.err
+	}
+	if b.rows == 0 {
+		return nil
+	}
+
+	if b.tx == nil {
+		tx, err := b.conn.BeginTx(ctx, nil)
+		if err != nil {
+			return b.fail(err)
+		}
+		b.tx = tx
+	}
+
+	q := b.insert + b.values.String()
+	b.values.Reset()
+	b.rows = 0
+
+	var n int64
+	err := b.conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*Conn)
+		if !ok {
+			return fmt.Errorf("Not a MonetDB connection")
+		}
+		var err error
+		n, err = c.execRows(ctx, q)
+		return err
+	})
+
+	b.results = append(b.results, BatchResult{Rows: n, Err: err})
+	if err != nil {
+		return b.fail(fmt.Errorf("Batch %d: %w", len(b.results), err))
+	}
+	return nil
+}
+
+// Commit inserts the rest of the rows and commits the transaction.
+func (b *BatchInserter) Commit(ctx context.Context) error {
+	if err := b.Flush(ctx); err != nil {
+		return err
+	}
+	if b.tx == nil {
+		return nil
+	}
+
+	err := b.tx.Commit()
+	b.tx = nil
+	if err != nil {
+		return b.fail(err)
+	}
+	return nil
+}
+
+// Rollback discards the rows that were inserted and the ones in the
+// batch, and rolls the transaction back.
+func (b *BatchInserter) Rollback() error {
+	b.values.Reset()
+	b.rows = 0
+	if b.tx == nil {
+		return nil
+	}
+
+	err := b.tx.Rollback()
+	b.tx = nil
+	return err
+}
+
+// Results returns the results of the batches that were sent, in order.
+func (b *BatchInserter) Results() []BatchResult {
+	return b.results
+}
+
+// Rows returns the number of rows that were inserted so far.
+func (b *BatchInserter) Rows() int64 {
+	var n int64
+	for _, r := range b.results {
+		n += r.Rows
+	}
+	return n
+}
+
+// fail rolls the transaction back after an error, which is returned
+// from then on.
+func (b *BatchInserter) fail(err error) error {
+	b.Rollback()
+	b.err = err
+	return err
+}
+
+// execRows runs a statement without preparing it, and returns the number
+// of rows it affected.
+func (c *Conn) execRows(ctx context.Context, q string) (int64, error) {
+	s := newStmt(c, q)
+	finish, err := s.run(ctx, fmt.Sprintf("s%s;", q))
+	if err != nil {
+		return 0, err
+	}
+	if err := finish(c.mapi.drain()); err != nil {
+		return 0, err
+	}
+	return int64(s.rowCount), nil
+}
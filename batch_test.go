@@ -0,0 +1,159 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// newBatchServer counts the rows of the INSERT statements it receives,
+// and fails the ones that contain fail.
+func newBatchServer(t *testing.T, cmds *[]string, fail string) *fakeServer {
+	return newRecordingServer(t, cmds, func(cmd string) (string, bool) {
+		if !strings.HasPrefix(cmd, "sINSERT INTO ") {
+			return "", false
+		}
+		if fail != "" && strings.Contains(cmd, fail) {
+			return "!40000!INSERT INTO: PRIMARY KEY constraint violated\n", true
+		}
+		return fmt.Sprintf("&2 %d -1\n", strings.Count(cmd, "), (")+1), true
+	})
+}
+
+func openBatchConn(t *testing.T, s *fakeServer) (*sql.DB, *sql.Conn) {
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Error getting connection: %v", err)
+	}
+	return db, conn
+}
+
+func TestBatchInserter(t *testing.T) {
+	var cmds []string
+	s := newBatchServer(t, &cmds, "")
+	defer s.Close()
+	db, conn := openBatchConn(t, s)
+	defer db.Close()
+	defer conn.Close()
+
+	ctx := context.Background()
+	b := NewBatchInserter(conn, "sys.t", []string{"a", "b"}, 3)
+	for i := 0; i < 7; i++ {
+		if err := b.Insert(ctx, i, fmt.Sprintf("row %d", i)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if b.Rows() != 7 {
+		t.Errorf("Invalid number of rows: %d", b.Rows())
+	}
+	results := b.Results()
+	if len(results) != 3 || results[0].Rows != 3 || results[2].Rows != 1 {
+		t.Errorf("Invalid results: %v", results)
+	}
+
+	expected := []string{
+		"sSTART TRANSACTION;",
+		`sINSERT INTO "sys"."t" ("a", "b") VALUES (0, 'row 0'), (1, 'row 1'), (2, 'row 2');`,
+		`sINSERT INTO "sys"."t" ("a", "b") VALUES (3, 'row 3'), (4, 'row 4'), (5, 'row 5');`,
+		`sINSERT INTO "sys"."t" ("a", "b") VALUES (6, 'row 6');`,
+		"sCOMMIT;",
+	}
+	if len(cmds) < len(expected) || strings.Join(cmds[len(cmds)-len(expected):], "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Invalid commands: %v", cmds)
+	}
+}
+
+func TestBatchInserterBlockSize(t *testing.T) {
+	var cmds []string
+	s := newBatchServer(t, &cmds, "")
+	defer s.Close()
+	db, conn := openBatchConn(t, s)
+	defer db.Close()
+	defer conn.Close()
+
+	ctx := context.Background()
+	b := NewBatchInserter(conn, "t", nil, 0)
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 20; i++ {
+		if err := b.Insert(ctx, value); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// a row that doesn't fit in a block on its own
+	if err := b.Insert(ctx, strings.Repeat("y", 2*mapi_MAX_PACKAGE_LENGTH)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	inserts := 0
+	for _, cmd := range cmds {
+		if strings.HasPrefix(cmd, "sINSERT") {
+			inserts++
+			if len(cmd) > mapi_MAX_PACKAGE_LENGTH && strings.Count(cmd, "(") > 1 {
+				t.Errorf("Statement of %d bytes exceeds the block", len(cmd))
+			}
+		}
+	}
+	if inserts != 4 || b.Rows() != 21 {
+		t.Errorf("Invalid number of statements and rows: %d %d", inserts, b.Rows())
+	}
+}
+
+func TestBatchInserterErrors(t *testing.T) {
+	var cmds []string
+	s := newBatchServer(t, &cmds, "'fail'")
+	defer s.Close()
+	db, conn := openBatchConn(t, s)
+	defer db.Close()
+	defer conn.Close()
+
+	ctx := context.Background()
+	b := NewBatchInserter(conn, "t", []string{"a"}, 2)
+
+	if err := b.Insert(ctx, 1, 2); err == nil {
+		t.Errorf("Expected an error for the number of values")
+	}
+	if err := b.Insert(ctx, struct{}{}); err == nil || !strings.Contains(err.Error(), "Column 1") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := b.Insert(ctx, "a"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := b.Insert(ctx, "b"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	b.Insert(ctx, "fail")
+	err := b.Insert(ctx, "c")
+	if !errors.Is(err, ErrConflict) || !strings.HasPrefix(err.Error(), "Batch 2: ") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if cerr := b.Commit(ctx); cerr != err {
+		t.Errorf("Unexpected error: %v", cerr)
+	}
+
+	results := b.Results()
+	if len(results) != 2 || results[0].Err != nil || results[1].Err == nil {
+		t.Errorf("Invalid results: %v", results)
+	}
+	if count(cmds, "sROLLBACK;") != 1 || count(cmds, "sCOMMIT;") != 0 {
+		t.Errorf("The transaction was not rolled back: %v", cmds)
+	}
+}
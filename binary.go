@@ -0,0 +1,304 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// A server that supports the binary result set protocol announces it in
+// its challenge with an option BINARY=<level>.
+//
+// The blocks of a result set that follow the first one can then be
+// requested with
+//
+//	Xexportbin <query id> <offset> <count>
+//
+// The response holds the columns of the block one after the other,
+// followed by the end position of each column as a 64 bit integer. All
+// numbers are in the byte order of the server, which is given in the
+// challenge as well.
+//
+// Fixed size types are sent as arrays of their internal representation,
+// where NULL is the smallest value of an integer type, and NaN for a
+// floating point type. Strings are sent zero terminated, where NULL is
+// the single byte 0x80.
+//
+// The first block of a result set is always sent as text. The binary
+// format is only used when every column has a type that can be decoded
+// here, otherwise the result set is read as text.
+//
+// TestRecordedBinaryResults replays the responses of a real server, which
+// are recorded by TestRecordBinaryResults, and compares the values of
+// both formats.
+
+const mapi_BINARY_MIN_LEVEL = 1
+
+const mapi_BINARY_NULL_STRING = "\x80"
+
+// binaryDecoder decodes the values of a column, and returns the rest of
+// the column data.
+type binaryDecoder func(data []byte, order binary.ByteOrder, d description, dest []driver.Value) ([]byte, error)
+
+var binaryDecoders = map[string]binaryDecoder{
+	mdb_CHAR:      decodeStrings,
+	mdb_VARCHAR:   decodeStrings,
+	mdb_CLOB:      decodeStrings,
+	mdb_DECIMAL:   decodeDecimals,
+	mdb_TINYINT:   decodeInt8s,
+	mdb_SMALLINT:  decodeInt16s,
+	mdb_SHORTINT:  decodeInt16s,
+	mdb_INT:       decodeInt32s,
+	mdb_MEDIUMINT: decodeInt32s,
+	mdb_WRD:       decodeInt32s,
+	mdb_BIGINT:    decodeInt64s,
+	mdb_LONGINT:   decodeInt64s,
+	mdb_SERIAL:    decodeInt64s,
+	mdb_HUGEINT:   decodeHugeInts,
+	mdb_REAL:      decodeFloat32s,
+	mdb_FLOAT:     decodeFloat32s,
+	mdb_DOUBLE:    decodeFloat64s,
+	mdb_BOOLEAN:   decodeBools,
+}
+
+// binaryDecodable reports whether all columns can be read in the binary
+// format.
+func binaryDecodable(desc []description) bool {
+	if len(desc) == 0 {
+		return false
+	}
+	for _, d := range desc {
+		if _, ok := binaryDecoders[d.columnType]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeBinaryBlock decodes count rows of a binary block.
+func decodeBinaryBlock(data []byte, order binary.ByteOrder, desc []description, count int) ([][]driver.Value, error) {
+	n := len(desc)
+	if len(data) < 8*n {
+		return nil, binaryBlockError(data)
+	}
+
+	block := data
+	footer := data[len(data)-8*n:]
+	data = data[:len(data)-8*n]
+	if order.Uint64(footer[8*(n-1):]) != uint64(len(data)) {
+		return nil, binaryBlockError(block)
+	}
+
+	rows := make([][]driver.Value, count)
+	values := make([]driver.Value, count*n)
+	for i := range rows {
+		rows[i] = values[i*n : (i+1)*n]
+	}
+
+	column := make([]driver.Value, count)
+	start := uint64(0)
+	for i, d := range desc {
+		end := order.Uint64(footer[8*i:])
+		if end < start || end > uint64(len(data)) {
+			return nil, binaryBlockError(block)
+		}
+
+		rest, err := binaryDecoders[d.columnType](data[start:end], order, d, column)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) != 0 {
+			return nil, fmt.Errorf("Column %s has more than %d values", d.columnName, count)
+		}
+
+		for j, v := range column {
+			rows[j][i] = v
+		}
+		start = end
+	}
+
+	return rows, nil
+}
+
+// binaryBlockError returns the error for a block that is not in the
+// binary format, which is usually an error message of the server.
+func binaryBlockError(data []byte) error {
+	if bytes.HasPrefix(data, []byte(mapi_MSG_ERROR)) {
+		return parseErrors(string(data))
+	}
+	return fmt.Errorf("Invalid binary block of %d bytes", len(data))
+}
+
+// fixedColumn checks that data holds a value of size bytes for each row.
+func fixedColumn(data []byte, size int, d description, dest []driver.Value) ([]byte, error) {
+	if len(data) < size*len(dest) {
+		return nil, fmt.Errorf("Column %s has less than %d values", d.columnName, len(dest))
+	}
+	return data[size*len(dest):], nil
+}
+
+func decodeInt8s(data []byte, order binary.ByteOrder, d description, dest []driver.Value) ([]byte, error) {
+	rest, err := fixedColumn(data, 1, d, dest)
+	for i := 0; err == nil && i < len(dest); i++ {
+		if v := int8(data[i]); v == math.MinInt8 {
+			dest[i] = nil
+		} else {
+			dest[i] = v
+		}
+	}
+	return rest, err
+}
+
+func decodeInt16s(data []byte, order binary.ByteOrder, d description, dest []driver.Value) ([]byte, error) {
+	rest, err := fixedColumn(data, 2, d, dest)
+	for i := 0; err == nil && i < len(dest); i++ {
+		if v := int16(order.Uint16(data[2*i:])); v == math.MinInt16 {
+			dest[i] = nil
+		} else {
+			dest[i] = v
+		}
+	}
+	return rest, err
+}
+
+func decodeInt32s(data []byte, order binary.ByteOrder, d description, dest []driver.Value) ([]byte, error) {
+	rest, err := fixedColumn(data, 4, d, dest)
+	for i := 0; err == nil && i < len(dest); i++ {
+		if v := int32(order.Uint32(data[4*i:])); v == math.MinInt32 {
+			dest[i] = nil
+		} else {
+			dest[i] = v
+		}
+	}
+	return rest, err
+}
+
+func decodeInt64s(data []byte, order binary.ByteOrder, d description, dest []driver.Value) ([]byte, error) {
+	rest, err := fixedColumn(data, 8, d, dest)
+	for i := 0; err == nil && i < len(dest); i++ {
+		if v := int64(order.Uint64(data[8*i:])); v == math.MinInt64 {
+			dest[i] = nil
+		} else {
+			dest[i] = v
+		}
+	}
+	return rest, err
+}
+
+// decodeHugeInts decodes 128 bit integers, whose NULL is -2^127.
+func decodeHugeInts(data []byte, order binary.ByteOrder, d description, dest []driver.Value) ([]byte, error) {
+	rest, err := fixedColumn(data, 16, d, dest)
+	for i := 0; err == nil && i < len(dest); i++ {
+		var hi, lo uint64
+		if order == binary.LittleEndian {
+			lo, hi = order.Uint64(data[16*i:]), order.Uint64(data[16*i+8:])
+		} else {
+			hi, lo = order.Uint64(data[16*i:]), order.Uint64(data[16*i+8:])
+		}
+		if hi == 1<<63 && lo == 0 {
+			dest[i] = nil
+			continue
+		}
+		v := new(big.Int).Lsh(big.NewInt(int64(hi)), 64)
+		dest[i] = v.Add(v, new(big.Int).SetUint64(lo))
+	}
+	return rest, err
+}
+
+func decodeFloat32s(data []byte, order binary.ByteOrder, d description, dest []driver.Value) ([]byte, error) {
+	rest, err := fixedColumn(data, 4, d, dest)
+	for i := 0; err == nil && i < len(dest); i++ {
+		if v := math.Float32frombits(order.Uint32(data[4*i:])); v != v {
+			dest[i] = nil
+		} else {
+			dest[i] = v
+		}
+	}
+	return rest, err
+}
+
+func decodeFloat64s(data []byte, order binary.ByteOrder, d description, dest []driver.Value) ([]byte, error) {
+	rest, err := fixedColumn(data, 8, d, dest)
+	for i := 0; err == nil && i < len(dest); i++ {
+		if v := math.Float64frombits(order.Uint64(data[8*i:])); math.IsNaN(v) {
+			dest[i] = nil
+		} else {
+			dest[i] = v
+		}
+	}
+	return rest, err
+}
+
+func decodeBools(data []byte, order binary.ByteOrder, d description, dest []driver.Value) ([]byte, error) {
+	rest, err := fixedColumn(data, 1, d, dest)
+	for i := 0; err == nil && i < len(dest); i++ {
+		if v := int8(data[i]); v == math.MinInt8 {
+			dest[i] = nil
+		} else {
+			dest[i] = v != 0
+		}
+	}
+	return rest, err
+}
+
+// decodeDecimals decodes decimals, which are stored as integers of the
+// smallest size that fits the precision.
+func decodeDecimals(data []byte, order binary.ByteOrder, d description, dest []driver.Value) ([]byte, error) {
+	var decode binaryDecoder
+	switch {
+	case d.precision <= 2:
+		decode = decodeInt8s
+	case d.precision <= 4:
+		decode = decodeInt16s
+	case d.precision <= 9:
+		decode = decodeInt32s
+	case d.precision <= 18:
+		decode = decodeInt64s
+	default:
+		decode = decodeHugeInts
+	}
+
+	rest, err := decode(data, order, d, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range dest {
+		switch v := v.(type) {
+		case int8:
+			dest[i] = NewDecimal(int64(v), d.scale)
+		case int16:
+			dest[i] = NewDecimal(int64(v), d.scale)
+		case int32:
+			dest[i] = NewDecimal(int64(v), d.scale)
+		case int64:
+			dest[i] = NewDecimal(v, d.scale)
+		case *big.Int:
+			dest[i] = Decimal{unscaled: v, scale: d.scale}
+		}
+	}
+	return rest, nil
+}
+
+func decodeStrings(data []byte, order binary.ByteOrder, d description, dest []driver.Value) ([]byte, error) {
+	for i := range dest {
+		end := bytes.IndexByte(data, 0)
+		if end < 0 {
+			return nil, fmt.Errorf("Column %s has less than %d values", d.columnName, len(dest))
+		}
+		if v := string(data[:end]); v == mapi_BINARY_NULL_STRING {
+			dest[i] = nil
+		} else {
+			dest[i] = v
+		}
+		data = data[end+1:]
+	}
+	return data, nil
+}
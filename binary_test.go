@@ -0,0 +1,488 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const binaryChallenge = fakeChallenge + "sql=6:BINARY=1:"
+
+// intBinaryBlock renders rows start..start+count-1 of a single int column
+// in the binary format.
+func intBinaryBlock(start, count int) string {
+	var b bytes.Buffer
+	for i := start; i < start+count; i++ {
+		binary.Write(&b, binary.LittleEndian, int32(i))
+	}
+	binary.Write(&b, binary.LittleEndian, uint64(b.Len()))
+	return b.String()
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatalf("Invalid hex: %v", err)
+	}
+	return b
+}
+
+func TestDecodeBinaryBlock(t *testing.T) {
+	desc := []description{
+		{columnName: "a", columnType: "int"},
+		{columnName: "b", columnType: "varchar"},
+		{columnName: "c", columnType: "double"},
+		{columnName: "d", columnType: "boolean"},
+		{columnName: "e", columnType: "decimal", precision: 5, scale: 2},
+	}
+
+	// a block of three rows, of which the second one is all NULL
+	data := decodeHex(t, `
+		01000000 00000080 f9ffffff
+		6f6e6500 8000 00
+		000000000000f83f 000000000000f87f 000000000000d03f
+		01 80 00
+		d2040000 00000080 fbffffff
+		0c00000000000000 1300000000000000 2b00000000000000 2e00000000000000 3a00000000000000`)
+
+	rows, err := decodeBinaryBlock(data, binary.LittleEndian, desc, 3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := [][]driver.Value{
+		{int32(1), "one", float64(1.5), true, NewDecimal(1234, 2)},
+		{nil, nil, nil, nil, nil},
+		{int32(-7), "", float64(0.25), false, NewDecimal(-5, 2)},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Invalid rows: %v, expected: %v", rows, expected)
+	}
+}
+
+func TestDecodeBinaryBlockBigEndian(t *testing.T) {
+	desc := []description{
+		{columnName: "a", columnType: "smallint"},
+		{columnName: "b", columnType: "bigint"},
+	}
+	data := decodeHex(t, `
+		0001 8000
+		ffffffffffffffff 0000000000000100
+		0000000000000004 0000000000000014`)
+
+	rows, err := decodeBinaryBlock(data, binary.BigEndian, desc, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := [][]driver.Value{
+		{int16(1), int64(-1)},
+		{nil, int64(256)},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Invalid rows: %v, expected: %v", rows, expected)
+	}
+}
+
+func TestDecodeBinaryBlockHugeInt(t *testing.T) {
+	desc := []description{
+		{columnName: "a", columnType: "hugeint"},
+		{columnName: "b", columnType: "decimal", precision: 38, scale: 2},
+	}
+
+	max := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 127), big.NewInt(1))
+	min := new(big.Int).Neg(max)
+
+	tcs := []struct {
+		order binary.ByteOrder
+		data  string
+	}{
+		{binary.LittleEndian, `
+			ffffffffffffffffffffffffffffff7f 01000000000000000000000000000080 00000000000000000000000000000080
+			ffffffffffffffffffffffffffffffff 00000000000000000000000000000080 00000000000000000100000000000000
+			3000000000000000 6000000000000000`},
+		{binary.BigEndian, `
+			7fffffffffffffffffffffffffffffff 80000000000000000000000000000001 80000000000000000000000000000000
+			ffffffffffffffffffffffffffffffff 80000000000000000000000000000000 00000000000000010000000000000000
+			0000000000000030 0000000000000060`},
+	}
+
+	for _, tc := range tcs {
+		rows, err := decodeBinaryBlock(decodeHex(t, tc.data), tc.order, desc, 3)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		expected := [][]driver.Value{
+			{max, NewDecimal(-1, 2)},
+			{min, nil},
+			{nil, NewDecimalBig(new(big.Int).Lsh(big.NewInt(1), 64), 2)},
+		}
+		if !reflect.DeepEqual(rows, expected) {
+			t.Errorf("Invalid rows for %v: %v, expected: %v", tc.order, rows, expected)
+		}
+	}
+}
+
+func TestDecodeBinaryBlockInvalid(t *testing.T) {
+	desc := []description{{columnName: "a", columnType: "int"}}
+
+	tcs := []struct {
+		data  string
+		count int
+		err   string
+	}{
+		{hex.EncodeToString([]byte("!42000!no such result set\n")), 2, "Database error 42000: no such result set"},
+		{"01000000 0400000000000000", 2, "Column a has less than 2 values"},
+		{"01000000 02000000 0800000000000000", 1, "Column a has more than 1 values"},
+		{"01000000 0900000000000000", 1, "Invalid binary block of 12 bytes"},
+		{"0100", 1, "Invalid binary block of 2 bytes"},
+	}
+
+	for _, tc := range tcs {
+		_, err := decodeBinaryBlock(decodeHex(t, tc.data), binary.LittleEndian, desc, tc.count)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("Invalid error for %s: %v, expected: %s", tc.data, err, tc.err)
+		}
+	}
+}
+
+func TestBinaryDecodable(t *testing.T) {
+	tcs := []struct {
+		desc     []description
+		expected bool
+	}{
+		{[]description{{columnType: "int"}, {columnType: "clob"}}, true},
+		{[]description{{columnType: "decimal", precision: 18}}, true},
+		{[]description{{columnType: "decimal", precision: 38}}, true},
+		{[]description{{columnType: "hugeint"}}, true},
+		{[]description{{columnType: "int"}, {columnType: "date"}}, false},
+		{nil, false},
+	}
+
+	for _, tc := range tcs {
+		if v := binaryDecodable(tc.desc); v != tc.expected {
+			t.Errorf("Invalid result for %v: %v, expected: %v", tc.desc, v, tc.expected)
+		}
+	}
+}
+
+// readPaged reads all rows of a paging server, and returns the export
+// commands that were sent for it.
+func readPaged(t *testing.T, s *fakeServer, dsn string, cmds *[]string) []string {
+	db, err := sql.Open("monetdb", dsn)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT a FROM t")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var a int
+		if err := rows.Scan(&a); err != nil {
+			t.Fatalf("Error scanning row: %v", err)
+		}
+		if a != n {
+			t.Errorf("Invalid value: %d, expected: %d", a, n)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if n != 250 {
+		t.Errorf("Invalid number of rows: %d, expected: %d", n, 250)
+	}
+
+	var exports []string
+	for _, cmd := range *cmds {
+		if strings.HasPrefix(cmd, "Xexport") {
+			exports = append(exports, cmd)
+		}
+	}
+	return exports
+}
+
+func TestBinaryResults(t *testing.T) {
+	tcs := []struct {
+		challenge string
+		binary    bool
+		exports   []string
+	}{
+		{binaryChallenge, true, []string{"Xexportbin 4 100 100", "Xexportbin 4 200 50"}},
+		{binaryChallenge, false, []string{"Xexport 4 100 100", "Xexport 4 200 50"}},
+		{fakeChallenge, true, []string{"Xexport 4 100 100", "Xexport 4 200 50"}},
+	}
+
+	for _, tc := range tcs {
+		var cmds []string
+		s := newFakeServerChallenge(t, tc.challenge, pagingHandler(250, &cmds))
+
+		dsn := s.dsn()
+		if tc.binary {
+			dsn += "?binary=true"
+		}
+		exports := readPaged(t, s, dsn, &cmds)
+		s.Close()
+
+		if strings.Join(exports, ",") != strings.Join(tc.exports, ",") {
+			t.Errorf("Invalid commands: %v, expected: %v", exports, tc.exports)
+		}
+	}
+}
+
+func TestBinaryResultsError(t *testing.T) {
+	var cmds []string
+	paging := pagingHandler(250, &cmds)
+	s := newFakeServerChallenge(t, binaryChallenge, func(cmd string) string {
+		if strings.HasPrefix(cmd, "Xexportbin 4 200 ") {
+			return "!HY000!Xexportbin: result set not found\n"
+		}
+		return paging(cmd)
+	})
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn()+"?binary=true")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	rows, err := db.Query("SELECT a FROM t")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	if err := rows.Err(); err == nil || !strings.Contains(err.Error(), "result set not found") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if n != 200 {
+		t.Errorf("Invalid number of rows: %d, expected: %d", n, 200)
+	}
+	rows.Close()
+
+	if _, err := db.Exec("UPDATE t SET a = 1"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// recordedQueries are the queries of the recorded result sets, with
+// whether their blocks after the first one are read in the binary format.
+// Each has 250 rows, which are sent in three blocks of at most 100.
+var recordedQueries = []struct {
+	query  string
+	binary bool
+}{
+	{`SELECT CASE WHEN value % 7 = 0 THEN NULL ELSE CAST(value % 100 - 50 AS TINYINT) END AS t,
+		CASE WHEN value % 7 = 1 THEN NULL ELSE CAST(value * 100 - 12500 AS SMALLINT) END AS s,
+		CASE WHEN value % 7 = 2 THEN NULL ELSE CAST(value * 1000 AS INT) END AS i,
+		CASE WHEN value % 7 = 3 THEN NULL ELSE CAST(value AS BIGINT) * 100000000000 END AS b
+		FROM sys.generate_series(0, 250)`, true},
+	{`SELECT CASE WHEN value % 7 = 0 THEN NULL ELSE CAST(value AS DOUBLE) / 8 END AS d,
+		CASE WHEN value % 7 = 1 THEN NULL ELSE CAST(value AS REAL) / 4 END AS r,
+		CASE WHEN value % 7 = 2 THEN NULL ELSE value % 2 = 0 END AS bool,
+		CASE WHEN value % 7 = 3 THEN NULL ELSE CAST(CAST(value AS DOUBLE) / 4 - 30 AS DECIMAL(5,2)) END AS d5,
+		CASE WHEN value % 7 = 4 THEN NULL ELSE CAST(value AS DECIMAL(18,3)) * 1000000 END AS d18
+		FROM sys.generate_series(0, 250)`, true},
+	{`SELECT CASE WHEN value % 7 = 0 THEN NULL WHEN value % 7 = 1 THEN ''
+		ELSE 'row ' || CAST(value AS VARCHAR(10)) || ', "quoted" é' END AS v
+		FROM sys.generate_series(0, 250)`, true},
+	{`SELECT CAST(value AS INT) AS i, CAST('2020-01-01' AS DATE) AS d
+		FROM sys.generate_series(0, 250)`, false},
+}
+
+// recordingConfig returns the configuration of the connections of the
+// recordings, which has to be the same when they are recorded and when
+// they are replayed, as the driver has to send the same commands.
+func recordingConfig(c Config, port int, binary bool) Config {
+	r := NewConfig()
+	r.Username = c.Username
+	r.Password = c.Password
+	r.Database = c.Database
+	r.Hostname = "127.0.0.1"
+	r.Port = port
+	r.ReplySize = 100
+	r.Binary = binary
+	return r
+}
+
+// readRecordedQueries returns the rows of recordedQueries, as strings
+// of their Go types and values.
+func readRecordedQueries(t *testing.T, c Config) [][]string {
+	connector, err := NewConnector(c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	var results [][]string
+	for _, q := range recordedQueries {
+		rows, err := db.Query(q.query)
+		if err != nil {
+			t.Fatalf("Error running %s: %v", q.query, err)
+		}
+		columns, _ := rows.Columns()
+
+		var result []string
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(dest...); err != nil {
+				t.Fatalf("Error scanning row: %v", err)
+			}
+			var row []string
+			for _, v := range values {
+				row = append(row, fmt.Sprintf("%T %v", v, v))
+			}
+			result = append(result, strings.Join(row, ", "))
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatalf("Error reading %s: %v", q.query, err)
+		}
+		rows.Close()
+		results = append(results, result)
+	}
+	return results
+}
+
+// TestRecordBinaryResults records the responses of a real server to
+// recordedQueries, in the text and in the binary format, for
+// TestRecordedBinaryResults. It only runs when MONETDB_RECORD_DSN is set
+// to the DSN of a server that supports the binary format, such as
+//
+//	MONETDB_RECORD_DSN=monetdb:monetdb@localhost:50000/demo go test -run TestRecordBinaryResults
+func TestRecordBinaryResults(t *testing.T) {
+	dsn := os.Getenv("MONETDB_RECORD_DSN")
+	if dsn == "" {
+		t.Skip("MONETDB_RECORD_DSN is not set")
+	}
+	c, err := ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("Invalid MONETDB_RECORD_DSN: %v", err)
+	}
+
+	for name, binary := range map[string]bool{"results_text": false, "results_binary": true} {
+		r := startRecorder(t, net.JoinHostPort(c.Hostname, strconv.Itoa(c.Port)))
+		readRecordedQueries(t, recordingConfig(c, r.port(), binary))
+		rec, err := r.wait()
+		if err != nil {
+			t.Fatalf("Error recording %s: %v", name, err)
+		}
+		saveRecording(t, name, rec)
+	}
+}
+
+// TestRecordedBinaryResults replays the recordings of a real server, and
+// checks that the result sets that were read in the binary format have
+// the same values as the ones that were read as text.
+func TestRecordedBinaryResults(t *testing.T) {
+	text := loadRecording(t, "results_text")
+	bin := loadRecording(t, "results_binary")
+	if text == nil || bin == nil {
+		t.Skip("There are no recordings of a server, see TestRecordBinaryResults")
+	}
+
+	// the blocks at offset 100 and 200 of each binary result set
+	exports := 0
+	for _, e := range bin.Exchanges {
+		if strings.HasPrefix(e.Command, "Xexportbin ") {
+			exports++
+		}
+	}
+	expected := 0
+	for _, q := range recordedQueries {
+		if q.binary {
+			expected += 2
+		}
+	}
+	if exports != expected {
+		t.Errorf("Invalid number of binary blocks: %d, expected: %d", exports, expected)
+	}
+
+	results := make(map[*recording][][]string)
+	for _, rec := range []*recording{text, bin} {
+		s := newReplayServer(t, rec)
+		c, _ := ParseDSN(s.dsn())
+		results[rec] = readRecordedQueries(t, recordingConfig(c, s.port(), rec == bin))
+		s.Close()
+	}
+
+	for i, q := range recordedQueries {
+		textRows, binRows := results[text][i], results[bin][i]
+		if len(textRows) != 250 || len(binRows) != 250 {
+			t.Errorf("Invalid number of rows for %s: %d and %d, expected: %d", q.query, len(textRows), len(binRows), 250)
+			continue
+		}
+		for j := range textRows {
+			if binRows[j] != textRows[j] {
+				t.Errorf("Invalid row %d of %s: %s, expected: %s", j, q.query, binRows[j], textRows[j])
+			}
+		}
+	}
+}
+
+// TestRecorder checks the recording and replaying of a connection with a
+// fake server, as the recordings of a real server can't be made here.
+func TestRecorder(t *testing.T) {
+	var cmds []string
+	s := newFakeServerChallenge(t, binaryChallenge, pagingHandler(250, &cmds))
+	defer s.Close()
+
+	r := startRecorder(t, s.listener.Addr().String())
+	c, _ := ParseDSN(s.dsn())
+	exports := readPaged(t, s, recordingConfig(c, r.port(), true).FormatDSN(), &cmds)
+	rec, err := r.wait()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if rec.Challenge != binaryChallenge {
+		t.Errorf("Invalid challenge: %q, expected: %q", rec.Challenge, binaryChallenge)
+	}
+	if len(rec.Exchanges) != len(cmds) {
+		t.Fatalf("Invalid number of exchanges: %d, expected: %d", len(rec.Exchanges), len(cmds))
+	}
+	for i, e := range rec.Exchanges {
+		if e.Command != cmds[i] {
+			t.Errorf("Invalid command: %q, expected: %q", e.Command, cmds[i])
+		}
+	}
+
+	// readPaged checks the rows of the replay
+	replay := newReplayServer(t, rec)
+	defer replay.Close()
+	c, _ = ParseDSN(replay.dsn())
+	readPaged(t, replay, recordingConfig(c, replay.port(), true).FormatDSN(), new([]string))
+	if len(exports) != 2 || !strings.HasPrefix(exports[0], "Xexportbin ") {
+		t.Errorf("Invalid commands: %v", exports)
+	}
+}
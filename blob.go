@@ -0,0 +1,160 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNullBlob is returned by ReadBlob when the BLOB is NULL.
+var ErrNullBlob = errors.New("BLOB is NULL")
+
+// ReadBlob runs a query whose result is a single BLOB column, and passes
+// the value of its first row to fn, as a reader that decodes it while it
+// arrives. Unlike a []byte of a result set, the value is never held in
+// memory as a whole, which matters for objects of hundreds of megabytes.
+//
+// The query returns sql.ErrNoRows when there are no rows, and ErrNullBlob
+// when the value is NULL; fn is not called then. The reader can only be
+// used until fn returns, after which the rest of the response is
+// discarded. The driver's Conn is available through sql.Conn.Raw:
+//
+//	err = conn.Raw(func(driverConn any) error {
+//		c := driverConn.(*monetdb.Conn)
+//		return c.ReadBlob(ctx, "SELECT data FROM files WHERE id = ?", []driver.Value{id},
+//			func(r io.Reader) error {
+//				_, err := io.Copy(w, r)
+//				return err
+//			})
+//	})
+func (c *Conn) ReadBlob(ctx context.Context, query string, args []driver.Value, fn func(r io.Reader) error) error {
+	s := newStmt(c, query)
+	finish, err := s.exec(ctx, namedValues(args))
+	if err != nil {
+		return err
+	}
+
+	err = s.checkBlob()
+	var r *blobReader
+	if err == nil {
+		r, err = newBlobReader(c.mapi.reader)
+	}
+	if err == nil {
+		err = fn(r)
+	}
+
+	derr := c.mapi.drain()
+	if cerr := finish(derr); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return err
+	}
+	return derr
+}
+
+// checkBlob checks that the result of a statement is a single BLOB column
+// with at least one row.
+func (s *Stmt) checkBlob() error {
+	if s.queryId < 0 {
+		return fmt.Errorf("Query didn't result in a resultset")
+	}
+	if len(s.description) != 1 || s.description[0].columnType != mdb_BLOB {
+		return fmt.Errorf("Query didn't result in a single BLOB column")
+	}
+	if s.rowCount == 0 || s.blockRows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// blobReader decodes the hexadecimal blob of a tuple, straight from the
+// connection.
+type blobReader struct {
+	src  *bufio.Reader
+	done bool
+	err  error
+}
+
+// newBlobReader reads the start of the tuple, up to the blob.
+func newBlobReader(src *bufio.Reader) (*blobReader, error) {
+	start, err := src.Peek(len("[ NULL"))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(start) < 2 || start[0] != mapi_MSG_TUPLE[0] {
+		return nil, fmt.Errorf("Invalid tuple: %s", start)
+	}
+
+	n := 1
+	for n < len(start) && start[n] == ' ' {
+		n++
+	}
+	if bytes.HasPrefix(start[n:], []byte(mdb_NULL)) {
+		return nil, ErrNullBlob
+	}
+	if n < len(start) && start[n] == '"' {
+		n++
+	}
+	src.Discard(n)
+	return &blobReader{src: src}, nil
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	n := 0
+	for n < len(p) && !r.done {
+		// the buffered digits, or at least two
+		want := 2 * (len(p) - n)
+		if b := r.src.Buffered(); b < want {
+			want = max(b, 2)
+		}
+		buf, err := r.src.Peek(want)
+
+		end := 0
+		for end < len(buf) && isHexDigit(buf[end]) {
+			end++
+		}
+		if end < len(buf) {
+			// the end of the blob
+			if end%2 != 0 {
+				r.err = fmt.Errorf("Invalid blob: odd number of digits")
+				return n, r.err
+			}
+			r.done = true
+		} else if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("Invalid tuple: the blob is not terminated")
+			}
+			r.err = err
+			return n, err
+		}
+
+		end -= end % 2
+		hex.Decode(p[n:], buf[:end])
+		n += end / 2
+		r.src.Discard(end)
+	}
+
+	if r.done && n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
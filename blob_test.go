@@ -0,0 +1,206 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBlobReader(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	digits := hex.EncodeToString(data)
+
+	tcs := []struct {
+		line     string
+		expected []byte
+	}{
+		{"[ " + digits + "\t]\n", data},
+		{"[ " + strings.ToUpper(digits) + ",\t1\t]\n", data},
+		{"[ \"" + digits + "\"\t]\n", data},
+		{"[ \t]\n", []byte{}},
+		{"[ 00\t]", []byte{0}},
+	}
+
+	for _, tc := range tcs {
+		// a small buffer, so the blob is read in many parts
+		r, err := newBlobReader(bufio.NewReaderSize(strings.NewReader(tc.line), 16))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		b, err := io.ReadAll(iotest.OneByteReader(r))
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		} else if !bytes.Equal(b, tc.expected) {
+			t.Errorf("Invalid blob of %d bytes, expected: %d bytes", len(b), len(tc.expected))
+		}
+
+		r, _ = newBlobReader(bufio.NewReaderSize(strings.NewReader(tc.line), 16))
+		if err := iotest.TestReader(r, tc.expected); err != nil {
+			t.Errorf("Invalid reader: %v", err)
+		}
+	}
+}
+
+func TestBlobReaderInvalid(t *testing.T) {
+	tcs := []struct {
+		line string
+		err  string
+	}{
+		{"[ NULL\t]\n", "BLOB is NULL"},
+		{"[ NULL", "BLOB is NULL"},
+		{"&2 1 -1\n", "Invalid tuple: &2 1 -"},
+		{"", "Invalid tuple: "},
+		{"[ 123\t]\n", "Invalid blob: odd number of digits"},
+		{"[ 1234", "Invalid tuple: the blob is not terminated"},
+	}
+
+	for _, tc := range tcs {
+		r, err := newBlobReader(bufio.NewReaderSize(strings.NewReader(tc.line), 16))
+		if err == nil {
+			_, err = io.ReadAll(r)
+		}
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("Invalid error for %q: %v, expected: %s", tc.line, err, tc.err)
+		}
+	}
+}
+
+// newBlobServer returns a server for queries of the blob with the given
+// digits, and a function that returns the last command it received.
+func newBlobServer(t *testing.T, blob string) (*fakeServer, func() string) {
+	var mu sync.Mutex
+	var last string
+	lastCmd := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+
+	return newFakeServer(t, func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		last = cmd
+
+		switch {
+		case strings.HasPrefix(cmd, "sPREPARE "):
+			return "&5 1 1 6 1\n"
+		case strings.HasPrefix(cmd, "sEXEC 1 (1"):
+			return "&1 2 2 1 2\n% sys.files # table_name\n% data # name\n% blob # type\n" +
+				"[ " + blob + "\t]\n[ 00\t]\n"
+		case strings.HasPrefix(cmd, "sEXEC 1 (2"):
+			return "&1 2 1 1 1\n% sys.files # table_name\n% data # name\n% blob # type\n[ NULL\t]\n"
+		case strings.HasPrefix(cmd, "sEXEC 1 (3"):
+			return "&1 2 0 1 0\n% sys.files # table_name\n% data # name\n% blob # type\n"
+		case strings.HasPrefix(cmd, "sEXEC 1 (4"):
+			return "&1 2 1 1 1\n% sys.files # table_name\n% name # name\n% varchar # type\n[ \"x\"\t]\n"
+		}
+		return "&2 0 -1\n"
+	}), lastCmd
+}
+
+func TestReadBlob(t *testing.T) {
+	data := make([]byte, 3*mapi_MAX_PACKAGE_LENGTH)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	s, _ := newBlobServer(t, hex.EncodeToString(data))
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	readBlob := func(id int64, fn func(r io.Reader) error) error {
+		return conn.Raw(func(driverConn interface{}) error {
+			return driverConn.(*Conn).ReadBlob(ctx, "SELECT data FROM files WHERE id = ?", []driver.Value{id}, fn)
+		})
+	}
+
+	var b bytes.Buffer
+	if err := readBlob(1, func(r io.Reader) error {
+		_, err := io.Copy(&b, r)
+		return err
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(b.Bytes(), data) {
+		t.Errorf("Invalid blob of %d bytes, expected: %d bytes", b.Len(), len(data))
+	}
+
+	// the rest of the blob is discarded when fn stops early
+	stop := errors.New("stop")
+	if err := readBlob(1, func(r io.Reader) error {
+		io.ReadFull(r, make([]byte, 10))
+		return stop
+	}); err != stop {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	errs := map[int64]error{2: ErrNullBlob, 3: sql.ErrNoRows}
+	for id, expected := range errs {
+		if err := readBlob(id, func(r io.Reader) error {
+			t.Errorf("Unexpected call for %d", id)
+			return nil
+		}); err != expected {
+			t.Errorf("Invalid error for %d: %v, expected: %v", id, err, expected)
+		}
+	}
+	if err := readBlob(4, func(r io.Reader) error { return nil }); err == nil || err.Error() != "Query didn't result in a single BLOB column" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// the connection is still in step with the server
+	var v []byte
+	if err := conn.QueryRowContext(ctx, "SELECT data FROM files WHERE id = ?", 1).Scan(&v); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(v, data) {
+		t.Errorf("Invalid blob of %d bytes, expected: %d bytes", len(v), len(data))
+	}
+}
+
+func TestBlobArguments(t *testing.T) {
+	s, lastCmd := newBlobServer(t, "00")
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("INSERT INTO files VALUES (?, ?)", 5, []byte("\x00\xffbin'\"")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := "sEXEC 1 (5, blob '00ff62696e2722');"
+	if cmd := lastCmd(); cmd != expected {
+		t.Errorf("Invalid command: %s, expected: %s", cmd, expected)
+	}
+}
@@ -0,0 +1,428 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	shortDSN = regexp.MustCompile(`^((?P<username>[^:@]+?)(:(?P<password>.+))?@)?(?P<hostname>\[[0-9a-fA-F:.%]+\]|[a-zA-Z0-9._-]+?)(:(?P<port>\d+?))?/(?P<database>[^/]+?)$`)
+	timeZone = regexp.MustCompile(`^[+-]\d{2}:\d{2}$`)
+)
+
+// Dialer opens the network connection to the server. It is satisfied
+// by *net.Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Logger receives the informational messages that the server sends,
+// such as warnings. It is satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Config holds the settings of a connection to MonetDB.
+//
+// Use NewConfig or ParseDSN to get a Config with the default values.
+type Config struct {
+	Username string
+	Password string
+	Hostname string
+	Database string
+	Port     int
+
+	// PasswordHash is used instead of the Password when it is set, so
+	// the password itself doesn't need to be kept, see HashPassword.
+	// It is not part of the DSN.
+	PasswordHash string
+
+	// Socket is the path of a Unix domain socket. When it is set, it
+	// is used instead of Hostname and Port.
+	Socket string
+
+	// TLSConfig is nil for plain connections.
+	TLSConfig *tls.Config
+
+	// CertHash pins the server certificate by its fingerprint, in the
+	// form sha256:<hex>. It replaces the verification of the
+	// certificate chain.
+	CertHash string
+
+	// Schema is the schema that is set at the start of the session.
+	Schema string
+
+	// TimeZone is the time zone of the session, in the form +HH:MM.
+	TimeZone string
+
+	// ReplySize is the number of rows the server sends in the first
+	// block of a result set. Zero leaves the server's default.
+	ReplySize int
+
+	// NoAutoCommit turns autocommit off at the start of the session, so
+	// that the zero value of a Config has autocommit on, like the server.
+	NoAutoCommit bool
+
+	// Binary requests the binary result set protocol. It is
+	// experimental, as it hasn't been tested against a server yet.
+	Binary bool
+
+	// DecimalMode is the Go type of DECIMAL values in result sets,
+	// float64 unless it is set otherwise.
+	DecimalMode DecimalMode
+
+	// ConnectTimeout limits the time to connect and log in. Zero
+	// means no limit.
+	ConnectTimeout time.Duration
+
+	// CancelTimeout is the time the server gets to stop a cancelled
+	// query, before the connection is closed instead. Zero means
+	// the default of 5 seconds.
+	CancelTimeout time.Duration
+
+	// Dialer opens the network connection. When it is nil, a
+	// net.Dialer is used.
+	Dialer Dialer
+
+	// Logger receives the informational messages of the server. When
+	// it is nil, they are discarded.
+	Logger Logger
+
+	// UploadHandler reads the files of COPY INTO ... ON CLIENT, and
+	// DownloadHandler writes the ones of COPY ... INTO ... ON CLIENT.
+	// When they are nil, the server's requests are refused. They are
+	// not part of the DSN, see NewDirectoryHandler.
+	UploadHandler   UploadHandler
+	DownloadHandler DownloadHandler
+}
+
+// NewConfig returns a Config with the default values.
+func NewConfig() Config {
+	return Config{
+		Hostname: "localhost",
+		Port:     50000,
+	}
+}
+
+// ParseDSN parses a DSN in either the URL form
+//
+//	monetdb[s]://[username[:password]@]hostname[:port]/database[?options]
+//
+// or the short form
+//
+//	[username[:password]@]hostname[:port]/database[?options]
+func ParseDSN(name string) (Config, error) {
+	c := NewConfig()
+
+	var query string
+	var err error
+	if strings.HasPrefix(name, "monetdb://") || strings.HasPrefix(name, "monetdbs://") {
+		query, err = parseURL(&c, name)
+	} else {
+		query, err = parseShortDSN(&c, name)
+	}
+	if err != nil {
+		return Config{}, err
+	}
+
+	useTLS := strings.HasPrefix(name, "monetdbs://")
+	if err := parseOptions(&c, query, useTLS); err != nil {
+		return Config{}, err
+	}
+
+	return c, nil
+}
+
+// FormatDSN returns the configuration as a monetdb:// or monetdbs:// URL
+// that can be parsed by ParseDSN.
+//
+// Fields that hold Go values, such as Dialer, Logger and a custom
+// TLSConfig, can't be written in a DSN. A TLSConfig is written as
+// tls=true, or as tls=skip-verify when it skips the verification.
+func (c Config) FormatDSN() string {
+	u := url.URL{
+		Scheme: "monetdb",
+		Host:   c.Hostname,
+		Path:   "/" + c.Database,
+	}
+	if c.TLSConfig != nil {
+		u.Scheme = "monetdbs"
+	}
+	if c.Username != "" && c.Password != "" {
+		u.User = url.UserPassword(c.Username, c.Password)
+	} else if c.Username != "" {
+		u.User = url.User(c.Username)
+	}
+	if c.Port != 0 {
+		u.Host = net.JoinHostPort(c.Hostname, strconv.Itoa(c.Port))
+	} else if strings.Contains(c.Hostname, ":") {
+		u.Host = "[" + c.Hostname + "]"
+	}
+
+	options := url.Values{}
+	if c.TLSConfig != nil && c.TLSConfig.InsecureSkipVerify && c.CertHash == "" {
+		options.Set("tls", "skip-verify")
+	}
+	if c.CertHash != "" {
+		options.Set("certhash", c.CertHash)
+	}
+	if c.Socket != "" {
+		options.Set("sock", c.Socket)
+	}
+	if c.Schema != "" {
+		options.Set("schema", c.Schema)
+	}
+	if c.TimeZone != "" {
+		options.Set("timezone", c.TimeZone)
+	}
+	if c.ReplySize != 0 {
+		options.Set("replysize", strconv.Itoa(c.ReplySize))
+	}
+	if c.NoAutoCommit {
+		options.Set("autocommit", "off")
+	}
+	if c.Binary {
+		options.Set("binary", "on")
+	}
+	if c.DecimalMode != DecimalFloat64 {
+		options.Set("decimal", c.DecimalMode.String())
+	}
+	if c.ConnectTimeout != 0 {
+		options.Set("connect_timeout", c.ConnectTimeout.String())
+	}
+	if c.CancelTimeout != 0 {
+		options.Set("cancel_timeout", c.CancelTimeout.String())
+	}
+	// a space is written as %20, as a + is not a space in a DSN
+	u.RawQuery = strings.ReplaceAll(options.Encode(), "+", "%20")
+
+	return u.String()
+}
+
+// tlsConfig returns the TLS configuration for a connection, with the
+// certificate hash applied. It returns nil for plain connections.
+func (c Config) tlsConfig() (*tls.Config, error) {
+	if c.TLSConfig == nil {
+		if c.CertHash != "" {
+			return nil, fmt.Errorf("Option certhash requires TLS")
+		}
+		return nil, nil
+	}
+
+	t := c.TLSConfig.Clone()
+	if c.CertHash != "" {
+		if err := pinCertificate(t, c.CertHash); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// parseURL parses a monetdb:// or monetdbs:// URL. It returns the
+// query string with the options.
+func parseURL(c *Config, name string) (string, error) {
+	u, err := url.Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("Invalid DSN: %v", err)
+	}
+
+	if u.User != nil {
+		c.Username = u.User.Username()
+		c.Password, _ = u.User.Password()
+	}
+	if h := u.Hostname(); h != "" {
+		c.Hostname = h
+	}
+	if p := u.Port(); p != "" {
+		c.Port, err = strconv.Atoi(p)
+		if err != nil {
+			return "", fmt.Errorf("Invalid port: %s", p)
+		}
+	}
+
+	c.Database = strings.TrimPrefix(u.Path, "/")
+	if c.Database == "" || strings.Contains(c.Database, "/") {
+		return "", fmt.Errorf("Invalid DSN")
+	}
+
+	return u.RawQuery, nil
+}
+
+// parseShortDSN parses the [username[:password]@]hostname[:port]/database
+// form. It returns the query string with the options.
+func parseShortDSN(c *Config, name string) (string, error) {
+	// options follow the database name, which comes after the host
+	var query string
+	start := strings.LastIndex(name, "@") + 1
+	if i := strings.Index(name[start:], "/"); i >= 0 {
+		i += start
+		if j := strings.Index(name[i:], "?"); j >= 0 {
+			query = name[i+j+1:]
+			name = name[:i+j]
+		}
+	}
+
+	if !shortDSN.MatchString(name) {
+		return "", fmt.Errorf("Invalid DSN")
+	}
+	m := shortDSN.FindAllStringSubmatch(name, -1)[0]
+	n := shortDSN.SubexpNames()
+
+	for i, v := range m {
+		if n[i] == "username" {
+			c.Username = v
+		} else if n[i] == "password" {
+			c.Password = v
+		} else if n[i] == "hostname" {
+			c.Hostname = strings.Trim(v, "[]")
+		} else if n[i] == "port" && v != "" {
+			c.Port, _ = strconv.Atoi(v)
+		} else if n[i] == "database" {
+			c.Database = v
+		}
+	}
+
+	return query, nil
+}
+
+// splitOptions splits the query string of a DSN into its options, of which
+// the last one counts when an option is given more than once. Unlike in a
+// form, a + is not a space, so that a time zone can be written as +02:00.
+func splitOptions(query string) (map[string]string, error) {
+	options := map[string]string{}
+	for _, option := range strings.Split(query, "&") {
+		if option == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(option, "=")
+		key, err := url.PathUnescape(k)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DSN options: %v", err)
+		}
+		value, err := url.PathUnescape(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DSN options: %v", err)
+		}
+		options[key] = value
+	}
+	return options, nil
+}
+
+// parseOptions applies the options in the query string of a DSN.
+func parseOptions(c *Config, query string, useTLS bool) error {
+	options, err := splitOptions(query)
+	if err != nil {
+		return err
+	}
+
+	tlsOption := ""
+	if useTLS {
+		tlsOption = "true"
+	}
+	sockdir := ""
+
+	for k, value := range options {
+		switch k {
+		case "tls":
+			tlsOption = value
+		case "certhash":
+			c.CertHash = value
+		case "sock":
+			c.Socket = value
+		case "sockdir":
+			sockdir = value
+		case "schema":
+			c.Schema = value
+		case "timezone":
+			c.TimeZone, err = parseTimeZone(value)
+		case "replysize":
+			c.ReplySize, err = strconv.Atoi(value)
+			if err == nil && c.ReplySize < 0 {
+				err = fmt.Errorf("Invalid reply size: %s", value)
+			}
+		case "autocommit":
+			var on bool
+			on, err = parseBool(value)
+			c.NoAutoCommit = !on
+		case "binary":
+			c.Binary, err = parseBool(value)
+		case "decimal":
+			c.DecimalMode, err = parseDecimalMode(value)
+		case "connect_timeout":
+			c.ConnectTimeout, err = parseDuration(value)
+		case "cancel_timeout":
+			c.CancelTimeout, err = parseDuration(value)
+		default:
+			return fmt.Errorf("Unknown DSN option: %s", k)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid value for DSN option %s: %v", k, err)
+		}
+	}
+
+	if sockdir != "" && c.Socket == "" {
+		c.Socket = SocketPath(sockdir, c.Port)
+	}
+
+	c.TLSConfig, err = parseTLSConfig(tlsOption)
+	if err != nil {
+		return err
+	}
+
+	// check the certificate hash early
+	if _, err := c.tlsConfig(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// parseBool accepts on/off and yes/no besides the values that are
+// understood by strconv.ParseBool.
+func parseBool(v string) (bool, error) {
+	switch strings.ToLower(v) {
+	case "on", "yes":
+		return true, nil
+	case "off", "no":
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
+
+// parseTimeZone accepts a time zone as +HH:MM or as the number of
+// minutes east of UTC, and returns it as +HH:MM.
+func parseTimeZone(v string) (string, error) {
+	if timeZone.MatchString(v) {
+		return v, nil
+	}
+
+	minutes, err := strconv.Atoi(v)
+	if err != nil {
+		return "", fmt.Errorf("Invalid time zone: %s", v)
+	}
+	sign := '+'
+	if minutes < 0 {
+		sign = '-'
+		minutes = -minutes
+	}
+	return fmt.Sprintf("%c%02d:%02d", sign, minutes/60, minutes%60), nil
+}
+
+// parseDuration accepts a duration such as 1m30s, or a number of seconds.
+func parseDuration(v string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
@@ -5,61 +5,485 @@
 package monetdb
 
 import (
+	"context"
 	"database/sql/driver"
 	"fmt"
+	"math/big"
+	"strings"
+	"time"
 )
 
+// defaultCancelTimeout is the time the server gets to report a query that
+// has been stopped through a control connection, before the socket is
+// closed.
+const defaultCancelTimeout = 5 * time.Second
+
+// defaultReplySize is the number of rows in a block, unless the
+// configuration says otherwise. It is the server's default as well.
+const defaultReplySize = 100
+
+type replySizeKey struct{}
+
+// WithReplySize returns a context that makes a query fetch its result in
+// blocks of the given number of rows, instead of the reply size of the
+// connection.
+func WithReplySize(ctx context.Context, rows int) context.Context {
+	return context.WithValue(ctx, replySizeKey{}, rows)
+}
+
+// replySizeFromContext returns the reply size that is set in the context,
+// or the configured reply size.
+func replySizeFromContext(ctx context.Context, configured int) int {
+	if n, ok := ctx.Value(replySizeKey{}).(int); ok && n > 0 {
+		return n
+	}
+	if configured > 0 {
+		return configured
+	}
+	return defaultReplySize
+}
+
 type Conn struct {
-	config config
+	config Config
 	mapi   *MapiConn
+
+	// sessionId is the server-side id of the session, or -1 if the
+	// server didn't tell us.
+	sessionId int
+
+	// replySize is the reply size of the session.
+	replySize int
+
+	// active is the result set whose response is being read from the
+	// connection. It must be released before the next command.
+	active *Rows
+
+	// tx is the transaction that is open on the connection.
+	tx *Tx
+
+	// autoCommit is the autocommit mode of the session, as last reported
+	// by the server. It is off while a transaction is in progress.
+	autoCommit bool
+
+	// defaults are the settings of the session after it was set up,
+	// which are restored when a statement may have changed them.
+	defaults       session
+	sessionChanged bool
 }
 
-func newConn(c config) (*Conn, error) {
+func newConn(ctx context.Context, c Config) (*Conn, error) {
 	conn := &Conn{
-		config: c,
-		mapi:   nil,
+		config:    c,
+		mapi:      nil,
+		sessionId: -1,
+		replySize: defaultReplySize,
+
+		// a session starts in autocommit mode
+		autoCommit: true,
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if c.TimeZone != "" {
+		if conn.config.TimeZone, err = parseTimeZone(c.TimeZone); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.ConnectTimeout)
+		defer cancel()
 	}
 
 	m := NewMapi(c.Hostname, c.Port, c.Username, c.Password, c.Database, "sql")
-	err := m.Connect()
+	m.Socket = c.Socket
+	m.PasswordHash = c.PasswordHash
+	m.TLSConfig = tlsConfig
+	m.Dialer = c.Dialer
+	m.Logger = c.Logger
+	m.UploadHandler = c.UploadHandler
+	m.DownloadHandler = c.DownloadHandler
+	err = m.ConnectContext(ctx)
 	if err != nil {
 		return conn, err
 	}
 
 	conn.mapi = m
+
+	// The session id is needed to stop a running query from a control
+	// connection. Old servers don't know current_sessionid(), in which
+	// case cancelling a query will close the connection instead.
+	rows, err := conn.queryRows(ctx, "SELECT current_sessionid()")
+	if err == nil && len(rows) == 1 && len(rows[0]) == 1 {
+		if id, ok := rows[0][0].(int32); ok {
+			conn.sessionId = int(id)
+		}
+	}
+
+	if err := conn.initSession(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.saveSession(ctx)
+
 	return conn, nil
 }
 
+// initSession applies the session settings of the configuration.
+func (c *Conn) initSession(ctx context.Context) error {
+	if c.config.ReplySize > 0 {
+		if err := c.setReplySize(ctx, c.config.ReplySize); err != nil {
+			return err
+		}
+	}
+
+	if c.config.NoAutoCommit {
+		if err := c.setAutoCommit(ctx, false); err != nil {
+			return err
+		}
+	}
+
+	if c.config.Schema != "" {
+		q := fmt.Sprintf("SET SCHEMA %s", quoteIdentifier(c.config.Schema))
+		if _, err := c.executeContext(ctx, q); err != nil {
+			return err
+		}
+	}
+
+	if c.config.TimeZone != "" {
+		q := fmt.Sprintf("SET TIME ZONE INTERVAL '%s' HOUR TO MINUTE", c.config.TimeZone)
+		if _, err := c.executeContext(ctx, q); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *Conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *Conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return newStmt(c, query), nil
 }
 
+func (c *Conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s := newStmt(c, query)
+	return s.QueryContext(ctx, args)
+}
+
+func (c *Conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	s := newStmt(c, query)
+	return s.ExecContext(ctx, args)
+}
+
 func (c *Conn) Close() error {
-	c.mapi.Disconnect()
-	c.mapi = nil
+	if c.active != nil {
+		c.active.release(false)
+	}
+	if c.mapi != nil {
+		c.mapi.Disconnect()
+		c.mapi = nil
+	}
 	return nil
 }
 
 func (c *Conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx starts a transaction. When autocommit is off, the session is
+// always in a transaction, which is taken over by the Tx instead.
+// A transaction that was started with a START TRANSACTION statement is
+// not taken over.
+func (c *Conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil || !c.autoCommit && !c.config.NoAutoCommit {
+		return nil, fmt.Errorf("A transaction is already in progress, use savepoints to nest transactions")
+	}
+
+	q, err := startTransaction(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	t := newTx(c)
 
-	_, err := c.execute("START TRANSACTION")
+	if !c.autoCommit {
+		if opts != (driver.TxOptions{}) {
+			return nil, fmt.Errorf("Transaction options are not supported when autocommit is off")
+		}
+		c.tx = t
+		return t, nil
+	}
+
+	_, err = c.executeContext(ctx, q)
 	if err != nil {
 		t.err = err
+	} else {
+		t.started = true
+		c.tx = t
+		c.autoCommit = false
 	}
 
 	return t, t.err
 }
 
+// CheckNamedValue passes a Decimal or *big.Int argument on unchanged, so
+// that it is sent as an exact literal. Other arguments get the default
+// conversion.
+func (c *Conn) CheckNamedValue(nv *driver.NamedValue) error {
+	switch nv.Value.(type) {
+	case Decimal, *big.Int:
+		return nil
+	}
+	return driver.ErrSkip
+}
+
+// Tx returns the transaction that is open on the connection, or nil when
+// there is none.
+func (c *Conn) Tx() *Tx {
+	return c.tx
+}
+
 func (c *Conn) cmd(cmd string) (string, error) {
+	return c.cmdContext(context.Background(), cmd)
+}
+
+// wait makes the connection available for the next command. A result set
+// that is still being read keeps the rest of its current block in memory.
+func (c *Conn) wait() {
+	if c.active != nil {
+		c.active.release(true)
+	}
+}
+
+// setReplySize changes the number of rows the server sends in the first
+// block of a result set, when it differs from the current setting.
+func (c *Conn) setReplySize(ctx context.Context, rows int) error {
+	if rows == c.replySize {
+		return nil
+	}
+
+	cmd := fmt.Sprintf("Xreply_size %d", rows)
+	if _, err := c.cmdContext(ctx, cmd); err != nil {
+		return err
+	}
+	c.replySize = rows
+	return nil
+}
+
+// binaryResults reports whether result sets are read in the binary
+// format, which requires both the option and a server that supports it.
+func (c *Conn) binaryResults() bool {
+	return c.config.Binary && c.mapi.binaryLevel >= mapi_BINARY_MIN_LEVEL
+}
+
+// setAutoCommit changes the autocommit mode of the session.
+func (c *Conn) setAutoCommit(ctx context.Context, on bool) error {
+	cmd := "Xauto_commit 0"
+	if on {
+		cmd = "Xauto_commit 1"
+	}
+	if _, err := c.cmdContext(ctx, cmd); err != nil {
+		return err
+	}
+	c.autoCommit = on
+	return nil
+}
+
+// trackTransaction updates the autocommit mode from the &4 line of a
+// response, which the server sends after a statement that starts or ends
+// a transaction.
+func (c *Conn) trackTransaction(response string) {
+	for _, line := range strings.Split(response, "\n") {
+		if strings.HasPrefix(line, mapi_MSG_QTRANS) {
+			c.autoCommit = strings.TrimSpace(line[2:]) == "t"
+		}
+	}
+}
+
+// cmdContext sends a MAPI command while honouring the deadline and
+// cancellation of the given context.
+//
+// A command that is interrupted half-way leaves unread data on the socket,
+// so the connection is marked as broken and every later command will
+// return driver.ErrBadConn.
+func (c *Conn) cmdContext(ctx context.Context, cmd string) (string, error) {
+	finish, err := c.begin(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := c.mapi.Cmd(cmd)
+	if cerr := finish(err); cerr != nil {
+		return "", cerr
+	}
+	c.trackTransaction(r)
+
+	return r, err
+}
+
+// begin prepares the connection for the next command, and starts watching
+// the context. The returned function must be called with the result of
+// the command, see watchCancel.
+func (c *Conn) begin(ctx context.Context) (func(error) error, error) {
+	c.wait()
+
 	if c.mapi == nil {
-		return "", fmt.Errorf("Database connection closed")
+		return nil, fmt.Errorf("Database connection closed")
+	}
+	if c.mapi.State != MAPI_STATE_READY {
+		return nil, driver.ErrBadConn
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
-	return c.mapi.Cmd(cmd)
+	return c.watchCancel(ctx), nil
 }
 
 func (c *Conn) execute(q string) (string, error) {
+	return c.executeContext(context.Background(), q)
+}
+
+func (c *Conn) executeContext(ctx context.Context, q string) (string, error) {
 	cmd := fmt.Sprintf("s%s;", q)
-	return c.cmd(cmd)
+	return c.cmdContext(ctx, cmd)
+}
+
+// queryRows runs a query without preparing it and returns the rows
+// of the first block of its result.
+func (c *Conn) queryRows(ctx context.Context, q string) ([][]driver.Value, error) {
+	s := newStmt(c, q)
+	finish, err := s.run(ctx, fmt.Sprintf("s%s;", q))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.readTuples()
+	if cerr := finish(err); cerr != nil {
+		return nil, cerr
+	}
+	return rows, err
+}
+
+// watchCancel turns the deadline of the context into a socket deadline and
+// stops the running query once the context is done.
+//
+// The query is stopped on the server through a control connection, after
+// which the error response is read and the connection stays usable. When
+// that is not possible, the pending socket operation is interrupted.
+//
+// The returned function must be called with the result of the round trip.
+// It returns the context's error when the round trip was interrupted.
+func (c *Conn) watchCancel(ctx context.Context) func(error) error {
+	if ctx.Done() == nil {
+		return func(error) error { return nil }
+	}
+
+	m := c.mapi
+	if deadline, ok := ctx.Deadline(); ok {
+		// leave the server some time to stop the query
+		m.SetDeadline(deadline.Add(c.cancelTimeout()))
+	}
+
+	done := make(chan struct{})
+	cancelled := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := c.stopQuery(); err == nil {
+				m.SetDeadline(time.Now().Add(c.cancelTimeout()))
+			} else {
+				// unblock the pending read or write right away
+				m.SetDeadline(time.Unix(1, 0))
+			}
+			cancelled <- true
+		case <-done:
+			cancelled <- false
+		}
+	}()
+
+	return func(err error) error {
+		close(done)
+		interrupted := <-cancelled
+		m.SetDeadline(time.Time{})
+
+		if err == nil {
+			// the whole response has been read, the connection is fine
+			return nil
+		}
+		if interrupted || ctx.Err() != nil {
+			// A response that was cut off half-way has already moved
+			// the connection out of MAPI_STATE_READY. Otherwise the
+			// server reported the stopped query and we can go on.
+			return ctx.Err()
+		}
+		return nil
+	}
+}
+
+// stopQuery stops the queries that are running in this session. It opens
+// a second MAPI session with the same credentials, looks up the queries in
+// sys.queue() and stops them with sys.stop().
+func (c *Conn) stopQuery() error {
+	if c.sessionId < 0 {
+		return fmt.Errorf("Session id is unknown")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.cancelTimeout())
+	defer cancel()
+
+	ctl := &Conn{
+		config:     c.config,
+		mapi:       c.mapi.copy(),
+		sessionId:  -1,
+		autoCommit: true,
+	}
+	if err := ctl.mapi.ConnectContext(ctx); err != nil {
+		return err
+	}
+	defer ctl.Close()
+
+	deadline, _ := ctx.Deadline()
+	ctl.mapi.SetDeadline(deadline)
+
+	q := fmt.Sprintf("SELECT tag FROM sys.queue() WHERE sessionid = %d AND status = 'running'", c.sessionId)
+	rows, err := ctl.queryRows(context.Background(), q)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return fmt.Errorf("No running query found for session %d", c.sessionId)
+	}
+
+	for _, row := range rows {
+		q := fmt.Sprintf("CALL sys.stop(%v)", row[0])
+		if _, err := ctl.execute(q); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *Conn) cancelTimeout() time.Duration {
+	if c.config.CancelTimeout > 0 {
+		return c.config.CancelTimeout
+	}
+	return defaultCancelTimeout
+}
+
+// logf passes a message to the configured Logger, if there is one.
+func (c *Conn) logf(format string, v ...interface{}) {
+	if c.config.Logger != nil {
+		c.config.Logger.Printf(format, v...)
+	}
 }
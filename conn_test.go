@@ -0,0 +1,152 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryContextTimeout(t *testing.T) {
+	release := make(chan struct{})
+	s := newFakeServer(t, func(cmd string) string {
+		if strings.HasPrefix(cmd, "sEXEC ") {
+			<-release
+		}
+		return "&2 1 -1\n"
+	})
+	defer s.Close()
+	defer close(release)
+
+	dc, err := (&Driver{}).Open(s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer dc.Close()
+	c := dc.(*Conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = c.ExecContext(ctx, "UPDATE t SET a = 1", nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %v, expected: %v", err, context.DeadlineExceeded)
+	}
+
+	_, err = c.ExecContext(context.Background(), "UPDATE t SET a = 1", nil)
+	if err != driver.ErrBadConn {
+		t.Errorf("Unexpected error: %v, expected: %v", err, driver.ErrBadConn)
+	}
+}
+
+func TestQueryContextCancelled(t *testing.T) {
+	s := newFakeServer(t, func(cmd string) string {
+		return "&2 1 -1\n"
+	})
+	defer s.Close()
+
+	dc, err := (&Driver{}).Open(s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer dc.Close()
+	c := dc.(*Conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = c.ExecContext(ctx, "UPDATE t SET a = 1", nil)
+	if err != context.Canceled {
+		t.Fatalf("Unexpected error: %v, expected: %v", err, context.Canceled)
+	}
+
+	// nothing has been sent, the connection is still usable
+	_, err = c.ExecContext(context.Background(), "UPDATE t SET a = 1", nil)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestQueryContextStoppedOnServer(t *testing.T) {
+	release := make(chan struct{})
+	stopped := make(chan string, 1)
+	s := newFakeServer(t, func(cmd string) string {
+		switch {
+		case cmd == "sSELECT current_sessionid();":
+			return "&1 0 1 1 1\n% .%1 # table_name\n% %1 # name\n% int # type\n% 2 # length\n[ 42\t]\n"
+		case strings.HasPrefix(cmd, "sSELECT tag FROM sys.queue() WHERE sessionid = 42 "):
+			return "&1 1 1 1 1\n% .queue # table_name\n% tag # name\n% bigint # type\n% 1 # length\n[ 9\t]\n"
+		case cmd == "sCALL sys.stop(9);":
+			stopped <- cmd
+			close(release)
+			return ""
+		case cmd == "sPREPARE UPDATE t SET a = 1;":
+			return "&5 7 1 6 1\n"
+		case strings.HasPrefix(cmd, "sEXEC 7 ("):
+			<-release
+			return "!HY008!Query aborted\n"
+		}
+		return "&2 1 -1\n"
+	})
+	defer s.Close()
+
+	dc, err := (&Driver{}).Open(s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer dc.Close()
+	c := dc.(*Conn)
+
+	if c.sessionId != 42 {
+		t.Fatalf("Invalid session id: %d, expected: %d", c.sessionId, 42)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err = c.ExecContext(ctx, "UPDATE t SET a = 1", nil)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: %v, expected: %v", err, context.DeadlineExceeded)
+	}
+
+	select {
+	case <-stopped:
+	default:
+		t.Fatalf("Query was not stopped on the server")
+	}
+
+	// the error response has been read, the connection is still usable
+	_, err = c.ExecContext(context.Background(), "UPDATE u SET a = 1", nil)
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	s := newFakeUnixServer(t, dir, 50123, func(cmd string) string {
+		return "&2 1 -1\n"
+	})
+	defer s.Close()
+
+	dsns := []string{
+		"monetdb:monetdb@localhost/demo?sock=" + SocketPath(dir, 50123),
+		"monetdb:monetdb@localhost:50123/demo?sockdir=" + dir,
+	}
+	for _, dsn := range dsns {
+		c, err := openTestConn(t, dsn)
+		if err != nil {
+			t.Errorf("Error connecting: %s -> %v", dsn, err)
+			continue
+		}
+		if _, err := c.ExecContext(context.Background(), "UPDATE t SET a = 1", nil); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+)
+
+// Connector opens connections with a fixed Config. It can be passed to
+// sql.OpenDB to configure the connections in code instead of through a
+// DSN.
+//
+//	c := monetdb.NewConfig()
+//	c.Username = "monetdb"
+//	c.Password = "monetdb"
+//	c.Database = "demo"
+//	connector, err := monetdb.NewConnector(c)
+//	db := sql.OpenDB(connector)
+type Connector struct {
+	config Config
+}
+
+// NewConnector returns a Connector for the given configuration.
+func NewConnector(c Config) (*Connector, error) {
+	if c.Database == "" {
+		return nil, fmt.Errorf("No database given")
+	}
+	if c.Hostname == "" && c.Socket == "" {
+		c.Hostname = "localhost"
+	}
+	if c.Port == 0 {
+		c.Port = 50000
+	}
+	if _, err := c.tlsConfig(); err != nil {
+		return nil, err
+	}
+	if c.TimeZone != "" {
+		// it is written into a statement
+		tz, err := parseTimeZone(c.TimeZone)
+		if err != nil {
+			return nil, err
+		}
+		c.TimeZone = tz
+	}
+	if c.PasswordHash != "" {
+		if _, _, err := splitPasswordHash(c.PasswordHash); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Connector{config: c}, nil
+}
+
+// Connect opens a new connection to the database.
+func (c *Connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return newConn(ctx, c.config)
+}
+
+// Driver returns the underlying Driver of the Connector.
+func (c *Connector) Driver() driver.Driver {
+	return &Driver{}
+}
@@ -0,0 +1,227 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countingDialer struct {
+	net.Dialer
+	dials int
+}
+
+func (d *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dials++
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+type testLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+	l.mu.Unlock()
+}
+
+func TestConnector(t *testing.T) {
+	s := newFakeServer(t, func(cmd string) string {
+		return "#warning: be careful\n&2 3 -1\n"
+	})
+	defer s.Close()
+
+	d := &countingDialer{}
+	l := &testLogger{}
+
+	c := NewConfig()
+	c.Hostname = "127.0.0.1"
+	c.Port = s.port()
+	c.Username = "monetdb"
+	c.Password = "p@ss/word"
+	c.Database = "demo"
+	c.Dialer = d
+	c.Logger = l
+
+	connector, err := NewConnector(c)
+	if err != nil {
+		t.Fatalf("Error creating connector: %v", err)
+	}
+
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	r, err := db.Exec("UPDATE t SET a = ?", 1)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n, _ := r.RowsAffected(); n != 3 {
+		t.Errorf("Invalid rows affected: %d, expected: %d", n, 3)
+	}
+
+	if d.dials != 1 {
+		t.Errorf("Invalid number of dials: %d, expected: %d", d.dials, 1)
+	}
+	if len(l.messages) == 0 || l.messages[0] != "warning: be careful" {
+		t.Errorf("Invalid log messages: %v", l.messages)
+	}
+}
+
+func TestNewConnectorInvalid(t *testing.T) {
+	if _, err := NewConnector(Config{}); err == nil {
+		t.Errorf("Expected an error for a config without database")
+	}
+
+	c := NewConfig()
+	c.Database = "demo"
+	c.CertHash = "sha256:00"
+	if _, err := NewConnector(c); err == nil {
+		t.Errorf("Expected an error for a certificate hash without TLS")
+	}
+}
+
+func TestConnectorTimeZone(t *testing.T) {
+	var mu sync.Mutex
+	var timeZone string
+	s := newFakeServer(t, func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.HasPrefix(cmd, "sSET TIME ZONE") {
+			timeZone = cmd
+		}
+		return "&3\n"
+	})
+	defer s.Close()
+
+	c := NewConfig()
+	c.Hostname = "127.0.0.1"
+	c.Port = s.port()
+	c.Database = "demo"
+
+	// the time zone is written into a statement
+	c.TimeZone = "+01:00' HOUR TO MINUTE; DROP TABLE t; --"
+	if _, err := NewConnector(c); err == nil {
+		t.Errorf("Expected an error for an invalid time zone")
+	}
+	if _, err := (&Connector{config: c}).Connect(context.Background()); err == nil {
+		t.Errorf("Expected an error for an invalid time zone")
+	}
+
+	c.TimeZone = "120"
+	connector, err := NewConnector(c)
+	if err != nil {
+		t.Fatalf("Error creating connector: %v", err)
+	}
+	conn, err := connector.Connect(context.Background())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	conn.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if expected := "sSET TIME ZONE INTERVAL '+02:00' HOUR TO MINUTE;"; timeZone != expected {
+		t.Errorf("Invalid command: %s, expected: %s", timeZone, expected)
+	}
+}
+
+func TestConnectorConfigLiteral(t *testing.T) {
+	var cmds []string
+	s := newRecordingServer(t, &cmds, nil)
+	defer s.Close()
+
+	// a Config that doesn't come from NewConfig has autocommit on
+	connector, err := NewConnector(Config{Hostname: "127.0.0.1", Port: s.port(), Database: "demo"})
+	if err != nil {
+		t.Fatalf("Error creating connector: %v", err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	if _, err := db.Exec("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, cmd := range cmds {
+		if strings.HasPrefix(cmd, "Xauto_commit") {
+			t.Errorf("Autocommit was changed: %v", cmds)
+		}
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// a listener that never answers the login
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+
+	c := NewConfig()
+	c.Hostname = "127.0.0.1"
+	c.Port = l.Addr().(*net.TCPAddr).Port
+	c.Database = "demo"
+	c.ConnectTimeout = 50 * time.Millisecond
+
+	connector, err := NewConnector(c)
+	if err != nil {
+		t.Fatalf("Error creating connector: %v", err)
+	}
+
+	_, err = connector.Connect(context.Background())
+	if err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error: %v, expected: %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestFormatDSN(t *testing.T) {
+	dsns := []string{
+		"monetdb://me:p%40ss%2Fword@[::1]:1234/testdb",
+		"monetdb://localhost:50000/testdb?autocommit=off&replysize=1000&schema=foo&timezone=%2B02%3A00",
+		"monetdb://localhost:50000/testdb?schema=my%20schema%2B1",
+		"monetdbs://localhost:50000/testdb?tls=skip-verify",
+		"monetdb://localhost:50000/testdb?cancel_timeout=1s&connect_timeout=10s&sock=%2Ftmp%2F.s.monetdb.50000",
+	}
+
+	for _, dsn := range dsns {
+		c, err := ParseDSN(dsn)
+		if err != nil {
+			t.Errorf("Error parsing DSN: %s -> %v", dsn, err)
+			continue
+		}
+		f := c.FormatDSN()
+		if f != dsn {
+			t.Errorf("Invalid DSN: %s, expected: %s", f, dsn)
+		}
+
+		c2, err := ParseDSN(f)
+		if err != nil {
+			t.Errorf("Error parsing formatted DSN: %s -> %v", f, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.TLSConfig == nil, c2.TLSConfig == nil) {
+			t.Errorf("Invalid TLS config after round trip: %s", f)
+		}
+		c.TLSConfig, c2.TLSConfig = nil, nil
+		if !reflect.DeepEqual(c, c2) {
+			t.Errorf("Invalid config after round trip: %+v, expected: %+v", c2, c)
+		}
+	}
+
+	c := NewConfig()
+	c.Database = "demo"
+	if !strings.HasPrefix(c.FormatDSN(), "monetdb://localhost:50000/demo") {
+		t.Errorf("Invalid DSN: %s", c.FormatDSN())
+	}
+}
@@ -6,12 +6,13 @@ package monetdb
 
 import (
 	"database/sql/driver"
+	"encoding/hex"
 	"fmt"
+	"math/big"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
-	"unicode/utf8"
 )
 
 const (
@@ -23,7 +24,7 @@ const (
 	mdb_SMALLINT  = "smallint" // 16 bit integer
 	mdb_INT       = "int"      // 32 bit integer
 	mdb_BIGINT    = "bigint"   // 64 bit integer
-	mdb_HUGEINT   = "hugeint"  // 64 bit integer
+	mdb_HUGEINT   = "hugeint"  // 128 bit integer
 	mdb_SERIAL    = "serial"   // special 64 bit integer sequence generator
 	mdb_REAL      = "real"     // 32 bit floating point
 	mdb_DOUBLE    = "double"   // 64 bit floating point
@@ -63,52 +64,43 @@ var timeFormats = []string{
 	"15:04:05",
 }
 
+// mdb_NULL is a NULL value of any type in a tuple. It is never quoted, so
+// a string that reads NULL is told apart by its quotes.
+const mdb_NULL = "NULL"
+
+// isNull reports whether a value of a tuple is NULL.
+func isNull(v string) bool {
+	return strings.TrimSpace(v) == mdb_NULL
+}
+
 type toGoConverter func(string) (driver.Value, error)
 type toMonetConverter func(driver.Value) (string, error)
 
+// strip removes the quotes of a string and replaces its escapes. A value
+// that isn't quoted, such as an interval, is returned as it is.
 func strip(v string) (driver.Value, error) {
-	return unquote(strings.TrimSpace(v[1 : len(v)-1]))
-}
-
-// from strconv.contains
-// contains reports whether the string contains the byte c.
-func contains(s string, c byte) bool {
-	for i := 0; i < len(s); i++ {
-		if s[i] == c {
-			return true
-		}
+	if s, ok := quoted(v); ok {
+		return unquote(s)
 	}
-	return false
+	return v, nil
 }
 
-// adapted from strconv.Unquote
-func unquote(s string) (string, error) {
-	// Is it trivial?  Avoid allocation.
-	if !contains(s, '\\') {
-		return s, nil
+// quoted returns a value without its quotes, if it is quoted.
+func quoted(v string) (string, bool) {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		return v[1 : len(v)-1], true
 	}
-
-	var runeTmp [utf8.UTFMax]byte
-	buf := make([]byte, 0, 3*len(s)/2) // Try to avoid more allocations.
-	for len(s) > 0 {
-		c, multibyte, ss, err := strconv.UnquoteChar(s, '\'')
-		if err != nil {
-			fmt.Printf("E: %v\n -> %s\n", err, s)
-			return "", err
-		}
-		s = ss
-		if c < utf8.RuneSelf || !multibyte {
-			buf = append(buf, byte(c))
-		} else {
-			n := utf8.EncodeRune(runeTmp[:], c)
-			buf = append(buf, runeTmp[:n]...)
-		}
-	}
-	return string(buf), nil
+	return v, false
 }
 
+// toByteArray decodes a blob, which the server sends in hexadecimal.
 func toByteArray(v string) (driver.Value, error) {
-	return []byte(v[1 : len(v)-1]), nil
+	s, _ := quoted(v)
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid blob: %v", err)
+	}
+	return b, nil
 }
 
 func toDouble(v string) (driver.Value, error) {
@@ -160,6 +152,16 @@ func toInt64(v string) (driver.Value, error) {
 	return r, err
 }
 
+// toHugeInt converts a 128 bit integer, which doesn't fit in any of Go's
+// integer types.
+func toHugeInt(v string) (driver.Value, error) {
+	i, ok := new(big.Int).SetString(v, 10)
+	if !ok {
+		return nil, fmt.Errorf("Invalid hugeint: %q", v)
+	}
+	return i, nil
+}
+
 func parseTime(v string) (t time.Time, err error) {
 	for _, f := range timeFormats {
 		t, err = time.Parse(f, v)
@@ -208,7 +210,7 @@ var toGoMappers = map[string]toGoConverter{
 	mdb_INT:            toInt32,
 	mdb_WRD:            toInt32,
 	mdb_BIGINT:         toInt64,
-	mdb_HUGEINT:        toInt64,
+	mdb_HUGEINT:        toHugeInt,
 	mdb_SERIAL:         toInt64,
 	mdb_REAL:           toFloat,
 	mdb_DOUBLE:         toDouble,
@@ -227,6 +229,72 @@ var toGoMappers = map[string]toGoConverter{
 	mdb_FLOAT:          toFloat,
 }
 
+var (
+	scanTypeString    = reflect.TypeOf("")
+	scanTypeBytes     = reflect.TypeOf([]byte(nil))
+	scanTypeInt8      = reflect.TypeOf(int8(0))
+	scanTypeInt16     = reflect.TypeOf(int16(0))
+	scanTypeInt32     = reflect.TypeOf(int32(0))
+	scanTypeInt64     = reflect.TypeOf(int64(0))
+	scanTypeBigInt    = reflect.TypeOf((*big.Int)(nil))
+	scanTypeFloat32   = reflect.TypeOf(float32(0))
+	scanTypeFloat64   = reflect.TypeOf(float64(0))
+	scanTypeBool      = reflect.TypeOf(false)
+	scanTypeDate      = reflect.TypeOf(Date{})
+	scanTypeTime      = reflect.TypeOf(Time{})
+	scanTypeTimestamp = reflect.TypeOf(time.Time{})
+	scanTypeDecimal   = reflect.TypeOf(Decimal{})
+	scanTypeAny       = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+// scanTypes are the Go types of the values that the converters of
+// toGoMappers return.
+var scanTypes = map[string]reflect.Type{
+	mdb_CHAR:           scanTypeString,
+	mdb_VARCHAR:        scanTypeString,
+	mdb_CLOB:           scanTypeString,
+	mdb_BLOB:           scanTypeBytes,
+	mdb_SMALLINT:       scanTypeInt16,
+	mdb_INT:            scanTypeInt32,
+	mdb_WRD:            scanTypeInt32,
+	mdb_BIGINT:         scanTypeInt64,
+	mdb_HUGEINT:        scanTypeBigInt,
+	mdb_SERIAL:         scanTypeInt64,
+	mdb_REAL:           scanTypeFloat32,
+	mdb_DOUBLE:         scanTypeFloat64,
+	mdb_BOOLEAN:        scanTypeBool,
+	mdb_DATE:           scanTypeDate,
+	mdb_TIME:           scanTypeTime,
+	mdb_TIMESTAMP:      scanTypeTimestamp,
+	mdb_TIMESTAMPTZ:    scanTypeTimestamp,
+	mdb_INTERVAL:       scanTypeString,
+	mdb_MONTH_INTERVAL: scanTypeString,
+	mdb_SEC_INTERVAL:   scanTypeString,
+	mdb_TINYINT:        scanTypeInt8,
+	mdb_SHORTINT:       scanTypeInt16,
+	mdb_MEDIUMINT:      scanTypeInt32,
+	mdb_LONGINT:        scanTypeInt64,
+	mdb_FLOAT:          scanTypeFloat32,
+}
+
+// scanType returns the Go type of the values of a column. Decimals depend
+// on the DecimalMode, an unknown type is reported as interface{}.
+func scanType(columnType string, mode DecimalMode) reflect.Type {
+	if columnType == mdb_DECIMAL {
+		switch mode {
+		case DecimalString:
+			return scanTypeString
+		case DecimalFloat64:
+			return scanTypeFloat64
+		}
+		return scanTypeDecimal
+	}
+	if t, ok := scanTypes[columnType]; ok {
+		return t
+	}
+	return scanTypeAny
+}
+
 func toString(v driver.Value) (string, error) {
 	return fmt.Sprintf("%v", v), nil
 }
@@ -238,14 +306,39 @@ func toQuotedString(v driver.Value) (string, error) {
 	return fmt.Sprintf("'%v'", s), nil
 }
 
+// quoteIdentifier quotes a name, such as a schema, table or column name,
+// so it can be used in a query.
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// quoteTable quotes a table name, which may be given as schema.table.
+func quoteTable(table string) string {
+	if schema, name, ok := strings.Cut(table, "."); ok {
+		return quoteIdentifier(schema) + "." + quoteIdentifier(name)
+	}
+	return quoteIdentifier(table)
+}
+
+// toBigIntString sends a *big.Int as an integer literal, which the server
+// reads as a hugeint when it is too large for a bigint.
+func toBigIntString(v driver.Value) (string, error) {
+	i := v.(*big.Int)
+	if i == nil {
+		return "NULL", nil
+	}
+	return i.String(), nil
+}
+
 func toNull(v driver.Value) (string, error) {
 	return "NULL", nil
 }
 
+// toByteString sends a []byte as a blob literal, in hexadecimal.
 func toByteString(v driver.Value) (string, error) {
 	switch val := v.(type) {
 	case []uint8:
-		return toQuotedString(string(val))
+		return fmt.Sprintf("blob '%x'", val), nil
 	default:
 		return "", fmt.Errorf("Unsupported type")
 	}
@@ -278,10 +371,18 @@ var toMonetMappers = map[string]toMonetConverter{
 	"time.Time":    toQuotedString,
 	"monetdb.Time": toDateTimeString,
 	"monetdb.Date": toDateTimeString,
+
+	"monetdb.Decimal": toDecimalLiteral,
+	"*big.Int":        toBigIntString,
 }
 
+// convertToGo converts a value of a tuple, where NULL is nil for every
+// type.
 func convertToGo(value, dataType string) (driver.Value, error) {
 	if mapper, ok := toGoMappers[dataType]; ok {
+		if isNull(value) {
+			return nil, nil
+		}
 		value := strings.TrimSpace(value)
 		return mapper(value)
 	}
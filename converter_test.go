@@ -7,6 +7,8 @@ package monetdb
 import (
 	"bytes"
 	"database/sql/driver"
+	"math/big"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -32,7 +34,8 @@ func TestConvertToMonet(t *testing.T) {
 		tc{true, "true"},
 		tc{false, "false"},
 		tc{nil, "NULL"},
-		tc{[]byte{1, 2, 3}, "'" + string([]byte{1, 2, 3}) + "'"},
+		tc{[]byte{1, 2, 3, 0xab}, "blob '010203ab'"},
+		tc{[]byte{}, "blob ''"},
 		tc{Time{10, 20, 30}, "'10:20:30'"},
 		tc{Date{2001, time.January, 2}, "'2001-01-02'"},
 		tc{time.Date(2001, time.January, 2, 10, 20, 30, 0, time.FixedZone("CET", 3600)),
@@ -63,7 +66,6 @@ func TestConvertToGo(t *testing.T) {
 		tc{"32", "mediumint", int32(32)},
 		tc{"64", "bigint", int64(64)},
 		tc{"64", "longint", int64(64)},
-		tc{"64", "hugeint", int64(64)},
 		tc{"64", "serial", int64(64)},
 		tc{"3.2", "float", float32(3.2)},
 		tc{"3.2", "real", float32(3.2)},
@@ -79,7 +81,10 @@ func TestConvertToGo(t *testing.T) {
 		tc{"'quoted \\'string\\''", "char", "quoted 'string'"},
 		tc{"'quoted \\\\\\'string\\\\\\''", "char", "quoted \\'string\\'"},
 		tc{"'back\\\\slashed'", "char", "back\\slashed"},
-		tc{"'ABC'", "blob", []uint8{0x41, 0x42, 0x43}},
+		tc{"414243", "blob", []uint8{0x41, 0x42, 0x43}},
+		tc{"00fF0a", "blob", []uint8{0x00, 0xff, 0x0a}},
+		tc{"\"414243\"", "blob", []uint8{0x41, 0x42, 0x43}},
+		tc{"", "blob", []uint8{}},
 	}
 
 	for _, c := range tcs {
@@ -109,3 +114,81 @@ func compareByteArray(t *testing.T, val []byte, e driver.Value) bool {
 		return false
 	}
 }
+
+func TestHugeInt(t *testing.T) {
+	max := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 127), big.NewInt(1))
+	min := new(big.Int).Neg(max)
+
+	for _, e := range []*big.Int{max, min, big.NewInt(64), big.NewInt(-1)} {
+		v, err := convertToGo(" "+e.String()+" ", "hugeint")
+		if err != nil {
+			t.Errorf("Error converting value: %v -> %v", e, err)
+		} else if i, ok := v.(*big.Int); !ok || i.Cmp(e) != 0 {
+			t.Errorf("Invalid value: %#v, expected: %v", v, e)
+		}
+
+		s, err := convertToMonet(e)
+		if err != nil {
+			t.Errorf("Error converting value: %v -> %v", e, err)
+		} else if s != e.String() {
+			t.Errorf("Invalid value: %s, expected: %s", s, e)
+		}
+	}
+
+	if max.String() != "170141183460469231731687303715884105727" {
+		t.Errorf("Invalid maximum: %v", max)
+	}
+
+	if _, err := convertToGo("1.5", "hugeint"); err == nil {
+		t.Errorf("Expected an error for an invalid hugeint")
+	}
+	if s, err := convertToMonet((*big.Int)(nil)); err != nil || s != "NULL" {
+		t.Errorf("Invalid value: %s, %v, expected: NULL", s, err)
+	}
+}
+
+func TestScanType(t *testing.T) {
+	tcs := []struct {
+		columnType string
+		mode       DecimalMode
+		expected   reflect.Type
+	}{
+		{"hugeint", DecimalExact, reflect.TypeOf((*big.Int)(nil))},
+		{"bigint", DecimalExact, reflect.TypeOf(int64(0))},
+		{"varchar", DecimalExact, reflect.TypeOf("")},
+		{"timestamptz", DecimalExact, reflect.TypeOf(time.Time{})},
+		{"decimal", DecimalExact, reflect.TypeOf(Decimal{})},
+		{"decimal", DecimalString, reflect.TypeOf("")},
+		{"decimal", DecimalFloat64, reflect.TypeOf(float64(0))},
+		{"geometry", DecimalExact, reflect.TypeOf((*interface{})(nil)).Elem()},
+	}
+
+	for _, tc := range tcs {
+		if v := scanType(tc.columnType, tc.mode); v != tc.expected {
+			t.Errorf("Invalid type for %s (%v): %v, expected: %v", tc.columnType, tc.mode, v, tc.expected)
+		}
+	}
+
+	// every type that is converted has a scan type
+	for columnType := range toGoMappers {
+		if _, ok := scanTypes[columnType]; !ok && columnType != mdb_DECIMAL {
+			t.Errorf("No scan type for %s", columnType)
+		}
+	}
+}
+
+func TestConvertNull(t *testing.T) {
+	for columnType := range toGoMappers {
+		for _, v := range []string{"NULL", " NULL", "NULL "} {
+			if val, err := convertToGo(v, columnType); err != nil || val != nil {
+				t.Errorf("Invalid value for %q (%s): %#v, %v, expected: nil", v, columnType, val, err)
+			}
+		}
+	}
+
+	for _, columnType := range []string{"char", "varchar", "clob"} {
+		if v, err := convertToGo(`"NULL"`, columnType); err != nil || v != "NULL" {
+			t.Errorf("Invalid value for a quoted NULL (%s): %#v, %v", columnType, v, err)
+		}
+	}
+}
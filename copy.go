@@ -0,0 +1,298 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// copyBlockSize is the amount of data that is sent for each prompt of
+// the server during a COPY INTO ... FROM STDIN.
+const copyBlockSize = 1024 * 1024
+
+// CopyResult is the result of a bulk load.
+type CopyResult struct {
+	// Rows is the number of rows that were loaded.
+	Rows int64
+
+	// Rejected are the rows that could not be loaded.
+	Rejected []RejectedRow
+}
+
+// RejectedRow is a row that could not be loaded by a bulk load.
+type RejectedRow struct {
+	// Row is the number of the row in the data, starting at 1.
+	Row int64
+
+	// Column is the number of the field that could not be loaded,
+	// starting at 1, or 0 when the row itself is invalid.
+	Column int
+
+	Message string
+
+	// Input is the data of the row, if the server kept it.
+	Input string
+}
+
+// CopySource supplies the rows of CopyFromRows.
+type CopySource interface {
+	// Next moves to the next row. It returns false after the last one,
+	// or when an error occurred.
+	Next() bool
+
+	// Values returns the values of the current row.
+	Values() ([]driver.Value, error)
+
+	// Err returns the error that stopped Next, if any.
+	Err() error
+}
+
+// CopyFromSlice returns a CopySource for rows that are in memory.
+func CopyFromSlice(rows [][]driver.Value) CopySource {
+	return &sliceSource{rows: rows, row: -1}
+}
+
+type sliceSource struct {
+	rows [][]driver.Value
+	row  int
+}
+
+func (s *sliceSource) Next() bool {
+	s.row++
+	return s.row < len(s.rows)
+}
+
+func (s *sliceSource) Values() ([]driver.Value, error) {
+	return s.rows[s.row], nil
+}
+
+func (s *sliceSource) Err() error {
+	return nil
+}
+
+// CopyFrom loads CSV data into the given columns of a table with
+// COPY INTO ... FROM STDIN, which is much faster than inserting the rows
+// one by one. All columns are loaded when columns is empty. The table may
+// be given as schema.table.
+//
+// Fields are separated by commas and rows by newlines. A string may be
+// quoted with double quotes, in which a double quote or backslash is
+// escaped with a backslash. An unquoted NULL is a null value.
+//
+// The data is sent to the server as fast as it loads it. Rows that can't
+// be loaded are skipped, and returned as the Rejected rows of the result.
+// When reading r fails, the connection is closed, so that the server
+// discards the rows it received; the connection is then reported as bad
+// to database/sql.
+//
+// The driver's Conn is available through sql.Conn.Raw:
+//
+//	err = conn.Raw(func(driverConn any) error {
+//		res, err = driverConn.(*monetdb.Conn).CopyFrom(ctx, "t", nil, r)
+//		return err
+//	})
+func (c *Conn) CopyFrom(ctx context.Context, table string, columns []string, r io.Reader) (CopyResult, error) {
+	var res CopyResult
+
+	finish, err := c.begin(ctx)
+	if err != nil {
+		return res, err
+	}
+
+	resp, err := c.mapi.copyData(fmt.Sprintf("s%s;", copyQuery(table, columns)), r)
+	if cerr := finish(err); cerr != nil {
+		return res, cerr
+	}
+	if err != nil {
+		return res, err
+	}
+	c.trackTransaction(resp)
+	if err := parseErrors(resp); err != nil {
+		return res, err
+	}
+
+	for _, line := range strings.Split(resp, "\n") {
+		if strings.HasPrefix(line, mapi_MSG_QUPDATE) {
+			t := strings.Fields(line[2:])
+			res.Rows, _ = strconv.ParseInt(t[0], 10, 64)
+		}
+	}
+
+	res.Rejected, err = c.rejectedRows(ctx)
+	return res, err
+}
+
+// CopyFromRows loads the rows of src into the given columns of a table,
+// see CopyFrom. The values are of the types that a query accepts as
+// arguments.
+func (c *Conn) CopyFromRows(ctx context.Context, table string, columns []string, src CopySource) (CopyResult, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeCopyRows(pw, src))
+	}()
+
+	res, err := c.CopyFrom(ctx, table, columns, pr)
+
+	// the server may stop before all rows are read
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-done
+	return res, err
+}
+
+// copyQuery returns the COPY INTO statement for the data format of
+// CopyFrom.
+func copyQuery(table string, columns []string) string {
+	var b strings.Builder
+	b.WriteString("COPY INTO ")
+	b.WriteString(quoteTable(table))
+
+	if len(columns) > 0 {
+		names := make([]string, len(columns))
+		for i, c := range columns {
+			names[i] = quoteIdentifier(c)
+		}
+		fmt.Fprintf(&b, " (%s)", strings.Join(names, ", "))
+	}
+
+	b.WriteString(` FROM STDIN DELIMITERS ',', E'\n', '"' NULL AS 'NULL' BEST EFFORT`)
+	return b.String()
+}
+
+// rejectedRows returns the rows that the last bulk load skipped, and
+// clears them on the server.
+func (c *Conn) rejectedRows(ctx context.Context) ([]RejectedRow, error) {
+	rows, err := c.queryRows(ctx, `SELECT rowid, fldid, "message", COALESCE("input", '') FROM sys.rejects`)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	rejected := make([]RejectedRow, len(rows))
+	for i, row := range rows {
+		if len(row) != 4 {
+			return nil, fmt.Errorf("Invalid rejected row: %v", row)
+		}
+		r := &rejected[i]
+		if v, ok := row[0].(int64); ok {
+			r.Row = v
+		}
+		if v, ok := row[1].(int32); ok {
+			r.Column = int(v)
+		}
+		r.Message, _ = row[2].(string)
+		r.Message = strings.TrimSpace(r.Message)
+		r.Input, _ = row[3].(string)
+	}
+
+	_, err = c.executeContext(ctx, "CALL sys.clearrejects()")
+	return rejected, err
+}
+
+// writeCopyRows writes the rows of src in the data format of CopyFrom.
+func writeCopyRows(w io.Writer, src CopySource) error {
+	bw := bufio.NewWriterSize(w, copyBlockSize)
+	for src.Next() {
+		values, err := src.Values()
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			if i > 0 {
+				bw.WriteByte(',')
+			}
+			s, err := copyValue(v)
+			if err != nil {
+				return fmt.Errorf("Column %d: %v", i+1, err)
+			}
+			bw.WriteString(s)
+		}
+		bw.WriteByte('\n')
+	}
+	if err := src.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// copyValue returns a value as a field of the data format of CopyFrom.
+func copyValue(v driver.Value) (string, error) {
+	switch val := v.(type) {
+	case Time:
+		return fmt.Sprintf("%02d:%02d:%02d", val.Hour, val.Min, val.Sec), nil
+	case Date:
+		return fmt.Sprintf("%04d-%02d-%02d", val.Year, val.Month, val.Day), nil
+	}
+
+	v, err := driver.DefaultParameterConverter.ConvertValue(v)
+	if err != nil {
+		return "", err
+	}
+
+	switch val := v.(type) {
+	case nil:
+		return "NULL", nil
+	case string:
+		return copyQuote(val), nil
+	case []byte:
+		// as a blob
+		return hex.EncodeToString(val), nil
+	case time.Time:
+		return val.Format("2006-01-02 15:04:05.999999-07:00"), nil
+	default:
+		return fmt.Sprintf("%v", val), nil
+	}
+}
+
+var copyEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func copyQuote(s string) string {
+	return `"` + copyEscaper.Replace(s) + `"`
+}
+
+// copyData sends a command, and answers the prompts of the server for more
+// data with blocks read from r, and with an empty block at the end of r.
+// It returns the response that follows.
+//
+// When reading r fails, the connection is closed, as the server would
+// load the data it received so far when it is ended otherwise.
+func (c *MapiConn) copyData(operation string, r io.Reader) (string, error) {
+	if err := c.send(operation); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, copyBlockSize)
+	for {
+		resp, err := io.ReadAll(c.reader)
+		if err != nil {
+			return "", c.readError(err)
+		}
+		if string(resp) != mapi_MSG_MORE {
+			return string(resp), nil
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			c.Disconnect()
+			return "", err
+		}
+		if err := c.putBlock(buf[:n]); err != nil {
+			c.State = MAPI_STATE_INIT
+			return "", connectionLost(err)
+		}
+		c.nextResponse()
+	}
+}
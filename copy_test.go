@@ -0,0 +1,262 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// copyServer is the state of a fake server that loads data with COPY INTO
+// ... FROM STDIN.
+type copyServer struct {
+	mu      sync.Mutex
+	query   string
+	data    bytes.Buffer
+	blocks  int
+	copying bool
+
+	// fail is the response after the given number of data blocks.
+	fail      string
+	failAfter int
+
+	rejects string
+	cleared bool
+}
+
+func (s *copyServer) handle(cmd string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.copying {
+		if cmd == "" {
+			s.copying = false
+			return fmt.Sprintf("&2 %d -1\n", strings.Count(s.data.String(), "\n"))
+		}
+		s.data.WriteString(cmd)
+		s.blocks++
+		if s.fail != "" && s.blocks == s.failAfter {
+			s.copying = false
+			return s.fail
+		}
+		return mapi_MSG_MORE
+	}
+
+	switch {
+	case strings.HasPrefix(cmd, "sCOPY INTO "):
+		s.query = cmd
+		s.copying = true
+		return mapi_MSG_MORE
+	case strings.Contains(cmd, "sys.rejects"):
+		header := "% sys.rejects,\tsys.rejects,\tsys.rejects,\tsys.rejects # table_name\n" +
+			"% rowid,\tfldid,\tmessage,\tinput # name\n" +
+			"% bigint,\tint,\tclob,\tclob # type\n" +
+			"% 1,\t1,\t0,\t0 # length\n"
+		n := strings.Count(s.rejects, "\n")
+		return fmt.Sprintf("&1 0 %d 4 %d\n", n, n) + header + s.rejects
+	case cmd == "sCALL sys.clearrejects();":
+		s.cleared = true
+		return ""
+	}
+	return "&2 1 -1\n"
+}
+
+func (s *copyServer) start(t *testing.T) *fakeServer {
+	return newFakeServer(t, s.handle)
+}
+
+func TestCopyQuery(t *testing.T) {
+	tcs := []struct {
+		table    string
+		columns  []string
+		expected string
+	}{
+		{"t", nil, `COPY INTO "t" FROM STDIN`},
+		{"sys.t", []string{"a", `b"c`}, `COPY INTO "sys"."t" ("a", "b""c") FROM STDIN`},
+	}
+
+	for _, tc := range tcs {
+		q := copyQuery(tc.table, tc.columns)
+		if !strings.HasPrefix(q, tc.expected+" DELIMITERS ") || !strings.HasSuffix(q, " BEST EFFORT") {
+			t.Errorf("Invalid query: %s, expected: %s", q, tc.expected)
+		}
+	}
+}
+
+func TestCopyFrom(t *testing.T) {
+	cs := &copyServer{}
+	s := cs.start(t)
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	// more than one block
+	var data bytes.Buffer
+	rows := 0
+	for data.Len() < 2*copyBlockSize+100 {
+		fmt.Fprintf(&data, "%d,\"row %d\"\n", rows, rows)
+		rows++
+	}
+	expected := data.String()
+
+	res, err := c.CopyFrom(context.Background(), "t", []string{"a", "b"}, &data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if res.Rows != int64(rows) || len(res.Rejected) != 0 {
+		t.Errorf("Invalid result: %d %v, expected: %d rows", res.Rows, res.Rejected, rows)
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.data.String() != expected {
+		t.Errorf("Invalid data: %d bytes, expected: %d", cs.data.Len(), len(expected))
+	}
+	if cs.blocks != 3 {
+		t.Errorf("Invalid number of blocks: %d", cs.blocks)
+	}
+	if !strings.HasPrefix(cs.query, `sCOPY INTO "t" ("a", "b") FROM STDIN`) {
+		t.Errorf("Invalid query: %s", cs.query)
+	}
+}
+
+func TestCopyFromRows(t *testing.T) {
+	cs := &copyServer{}
+	s := cs.start(t)
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	ts := time.Date(2024, 2, 29, 13, 14, 15, 500000000, time.FixedZone("", 3600))
+	src := CopyFromSlice([][]driver.Value{
+		{1, "a", 1.5, true},
+		{nil, `quote " and \ backslash`, []byte("bytes"), ts},
+		{int64(-3), "multi\nline", Date{Year: 2024, Month: 3, Day: 1}, Time{Hour: 1, Min: 2, Sec: 3}},
+	})
+
+	res, err := c.CopyFromRows(context.Background(), "t", nil, src)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cs.mu.Lock()
+	data := cs.data.String()
+	cs.mu.Unlock()
+
+	expected := "1,\"a\",1.5,true\n" +
+		"NULL,\"quote \\\" and \\\\ backslash\",6279746573,2024-02-29 13:14:15.5+01:00\n" +
+		"-3,\"multi\nline\",2024-03-01,01:02:03\n"
+	if data != expected {
+		t.Errorf("Invalid data: %q, expected: %q", data, expected)
+	}
+	// the quoted newline counts as a row on this server
+	if res.Rows != 4 {
+		t.Errorf("Invalid number of rows: %d", res.Rows)
+	}
+
+	_, err = c.CopyFromRows(context.Background(), "t", nil, CopyFromSlice([][]driver.Value{{struct{}{}}}))
+	if err == nil || !strings.Contains(err.Error(), "Column 1") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestCopyFromRejected(t *testing.T) {
+	cs := &copyServer{
+		rejects: "[ 2,\t1,\t\"x is not an integer\\n\",\t\"x,b\"\t]\n" +
+			"[ 3,\t0,\t\"row has too many fields\",\t\"\"\t]\n",
+	}
+	s := cs.start(t)
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	res, err := c.CopyFrom(context.Background(), "t", nil, strings.NewReader("1,a\nx,b\n2,c,3\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []RejectedRow{
+		{Row: 2, Column: 1, Message: "x is not an integer", Input: "x,b"},
+		{Row: 3, Column: 0, Message: "row has too many fields"},
+	}
+	if len(res.Rejected) != len(expected) {
+		t.Fatalf("Invalid rejected rows: %v", res.Rejected)
+	}
+	for i, r := range res.Rejected {
+		if r != expected[i] {
+			t.Errorf("Invalid rejected row: %#v, expected: %#v", r, expected[i])
+		}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if !cs.cleared {
+		t.Errorf("Rejected rows were not cleared")
+	}
+}
+
+func TestCopyFromErrors(t *testing.T) {
+	cs := &copyServer{
+		fail:      "!42000!COPY INTO: record separator missing\n",
+		failAfter: 1,
+	}
+	s := cs.start(t)
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	// the server stops before all data is sent
+	data := strings.Repeat("1,2\n", copyBlockSize)
+	_, err = c.CopyFrom(context.Background(), "t", nil, strings.NewReader(data))
+	var dbErr *Error
+	if !errors.As(err, &dbErr) || dbErr.Code != "42000" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !c.IsValid() {
+		t.Errorf("Connection is not valid after a server error")
+	}
+
+	// a failing reader closes the connection
+	failing := io.MultiReader(strings.NewReader("1,2\n"), &errorReader{errors.New("read failed")})
+	_, err = c.CopyFrom(context.Background(), "t", nil, failing)
+	if err == nil || err.Error() != "read failed" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if c.IsValid() {
+		t.Errorf("Connection is valid after a failed load")
+	}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
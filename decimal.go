@@ -0,0 +1,245 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DecimalMode is the Go type of the DECIMAL and NUMERIC values in a
+// result set.
+type DecimalMode int
+
+const (
+	// DecimalFloat64 returns them as a float64, which loses precision.
+	// It is the default, as it was the only mode of earlier versions.
+	DecimalFloat64 DecimalMode = iota
+
+	// DecimalString returns them as a string, as the server sends them.
+	DecimalString
+
+	// DecimalExact returns them as Decimal.
+	DecimalExact
+)
+
+func (m DecimalMode) String() string {
+	switch m {
+	case DecimalExact:
+		return "exact"
+	case DecimalString:
+		return "string"
+	case DecimalFloat64:
+		return "float64"
+	}
+	return fmt.Sprintf("DecimalMode(%d)", int(m))
+}
+
+// parseDecimalMode parses the value of the decimal DSN option.
+func parseDecimalMode(v string) (DecimalMode, error) {
+	for _, m := range []DecimalMode{DecimalFloat64, DecimalString, DecimalExact} {
+		if v == m.String() {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown decimal mode: %s, expected float64, string or exact", v)
+}
+
+// Decimal is an exact value of MonetDB's DECIMAL and NUMERIC types. It is
+// an unscaled integer and a scale, the number of digits after the decimal
+// point: 12.3400 is 123400 with scale 4.
+//
+// The zero value is 0.
+type Decimal struct {
+	// unscaled is never changed once the Decimal is made, so that
+	// copies can share it.
+	unscaled *big.Int
+	scale    int
+}
+
+// NewDecimal returns the Decimal unscaled * 10^-scale.
+func NewDecimal(unscaled int64, scale int) Decimal {
+	return Decimal{unscaled: big.NewInt(unscaled), scale: scale}
+}
+
+// NewDecimalBig returns the Decimal unscaled * 10^-scale.
+func NewDecimalBig(unscaled *big.Int, scale int) Decimal {
+	return Decimal{unscaled: new(big.Int).Set(unscaled), scale: scale}
+}
+
+// ParseDecimal parses a decimal number, such as -12.3400. The scale is
+// the number of digits after the decimal point.
+func ParseDecimal(s string) (Decimal, error) {
+	digits := s
+	if strings.HasPrefix(digits, "-") || strings.HasPrefix(digits, "+") {
+		digits = digits[1:]
+	}
+	integer, fraction, _ := strings.Cut(digits, ".")
+	if integer == "" && fraction == "" || !isDigits(integer) || !isDigits(fraction) {
+		return Decimal{}, fmt.Errorf("Invalid decimal: %q", s)
+	}
+
+	u, _ := new(big.Int).SetString(integer+fraction, 10)
+	if strings.HasPrefix(s, "-") {
+		u.Neg(u)
+	}
+	return Decimal{unscaled: u, scale: len(fraction)}, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// DecimalFromRat returns r as a Decimal with the given scale, rounded
+// half away from zero when it has more digits.
+func DecimalFromRat(r *big.Rat, scale int) Decimal {
+	if scale < 0 {
+		scale = 0
+	}
+
+	// num * 10^scale / denom, rounded
+	num := new(big.Int).Mul(r.Num(), pow10(scale))
+	q, m := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	twice := new(big.Int).Lsh(m.Abs(m), 1)
+	if twice.Cmp(r.Denom()) >= 0 {
+		if r.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return Decimal{unscaled: q, scale: scale}
+}
+
+// DecimalFromFloat returns f as a Decimal with the given scale, see
+// DecimalFromRat. An infinite f is an error.
+func DecimalFromFloat(f *big.Float, scale int) (Decimal, error) {
+	if f.IsInf() {
+		return Decimal{}, fmt.Errorf("Invalid decimal: %v", f)
+	}
+	r, _ := f.Rat(nil)
+	return DecimalFromRat(r, scale), nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// Unscaled returns the value without the decimal point.
+func (d Decimal) Unscaled() *big.Int {
+	if d.unscaled == nil {
+		return new(big.Int)
+	}
+	return new(big.Int).Set(d.unscaled)
+}
+
+// Scale returns the number of digits after the decimal point.
+func (d Decimal) Scale() int {
+	return d.scale
+}
+
+// Rat returns the value as a *big.Rat.
+func (d Decimal) Rat() *big.Rat {
+	return new(big.Rat).SetFrac(d.Unscaled(), pow10(d.scale))
+}
+
+// Float returns the value as a *big.Float, which is rounded when the
+// value can't be represented exactly.
+func (d Decimal) Float() *big.Float {
+	return new(big.Float).SetRat(d.Rat())
+}
+
+// Float64 returns the nearest float64 value.
+func (d Decimal) Float64() float64 {
+	f, _ := d.Rat().Float64()
+	return f
+}
+
+// String returns the value with its scale, as in -12.3400.
+func (d Decimal) String() string {
+	u := d.Unscaled()
+	digits := new(big.Int).Abs(u).String()
+	if d.scale > 0 {
+		if len(digits) <= d.scale {
+			digits = strings.Repeat("0", d.scale-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-d.scale] + "." + digits[len(digits)-d.scale:]
+	}
+	if u.Sign() < 0 {
+		return "-" + digits
+	}
+	return digits
+}
+
+// Scan implements sql.Scanner. A NULL can be scanned into a
+// sql.Null[Decimal].
+func (d *Decimal) Scan(src interface{}) error {
+	var err error
+	switch v := src.(type) {
+	case Decimal:
+		*d = v
+	case string:
+		*d, err = ParseDecimal(strings.TrimSpace(v))
+	case []byte:
+		*d, err = ParseDecimal(strings.TrimSpace(string(v)))
+	case int64:
+		*d = NewDecimal(v, 0)
+	case int32:
+		*d = NewDecimal(int64(v), 0)
+	case int16:
+		*d = NewDecimal(int64(v), 0)
+	case int8:
+		*d = NewDecimal(int64(v), 0)
+	case float64:
+		*d, err = ParseDecimal(strconv.FormatFloat(v, 'f', -1, 64))
+	case float32:
+		*d, err = ParseDecimal(strconv.FormatFloat(float64(v), 'f', -1, 32))
+	default:
+		err = fmt.Errorf("Can't scan %T into a Decimal", src)
+	}
+	return err
+}
+
+// Value implements driver.Valuer. The driver itself sends a Decimal as
+// an exact literal.
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// decimalValue returns a decimal of a result set as the Go type of the
+// given mode.
+func decimalValue(d Decimal, mode DecimalMode) driver.Value {
+	switch mode {
+	case DecimalString:
+		return d.String()
+	case DecimalFloat64:
+		return d.Float64()
+	}
+	return d
+}
+
+// toDecimal converts a decimal of a result set in the text format.
+func toDecimal(v string, mode DecimalMode) (driver.Value, error) {
+	switch mode {
+	case DecimalString:
+		return v, nil
+	case DecimalFloat64:
+		return toDouble(v)
+	}
+	return ParseDecimal(v)
+}
+
+// toDecimalLiteral sends a Decimal as a literal, which keeps it exact.
+func toDecimalLiteral(v driver.Value) (string, error) {
+	return v.(Decimal).String(), nil
+}
@@ -0,0 +1,202 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseDecimal(t *testing.T) {
+	tcs := []struct {
+		value    string
+		unscaled string
+		scale    int
+		str      string
+	}{
+		{"12.3400", "123400", 4, "12.3400"},
+		{"-12.3400", "-123400", 4, "-12.3400"},
+		{"+7", "7", 0, "7"},
+		{"0.05", "5", 2, "0.05"},
+		{"-.5", "-5", 1, "-0.5"},
+		{"5.", "5", 0, "5"},
+		{"99999999999999999999999999999999999.999", "99999999999999999999999999999999999999", 3, "99999999999999999999999999999999999.999"},
+	}
+
+	for _, tc := range tcs {
+		d, err := ParseDecimal(tc.value)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", tc.value, err)
+			continue
+		}
+		if d.Unscaled().String() != tc.unscaled || d.Scale() != tc.scale || d.String() != tc.str {
+			t.Errorf("Invalid decimal for %s: %s %d %s", tc.value, d.Unscaled(), d.Scale(), d)
+		}
+	}
+
+	for _, v := range []string{"", "-", ".", "1.2.3", "1e5", "NaN", "12a"} {
+		if _, err := ParseDecimal(v); err == nil {
+			t.Errorf("Expected an error for %q", v)
+		}
+	}
+
+	if s := (Decimal{}).String(); s != "0" {
+		t.Errorf("Invalid zero value: %s", s)
+	}
+}
+
+func TestDecimalConversions(t *testing.T) {
+	d := NewDecimal(-123456, 4)
+	if r := d.Rat(); r.Cmp(big.NewRat(-123456, 10000)) != 0 {
+		t.Errorf("Invalid rat: %v", r)
+	}
+	if f := d.Float64(); f != -12.3456 {
+		t.Errorf("Invalid float: %v", f)
+	}
+	if f, _ := d.Float().Float64(); f != -12.3456 {
+		t.Errorf("Invalid big float: %v", f)
+	}
+
+	tcs := []struct {
+		r        *big.Rat
+		scale    int
+		expected string
+	}{
+		{big.NewRat(1, 3), 4, "0.3333"},
+		{big.NewRat(2, 3), 4, "0.6667"},
+		{big.NewRat(-2, 3), 2, "-0.67"},
+		{big.NewRat(1, 8), 2, "0.13"},
+		{big.NewRat(-1, 8), 2, "-0.13"},
+		{big.NewRat(5, 1), 3, "5.000"},
+	}
+	for _, tc := range tcs {
+		if d := DecimalFromRat(tc.r, tc.scale); d.String() != tc.expected {
+			t.Errorf("Invalid decimal for %v: %s, expected: %s", tc.r, d, tc.expected)
+		}
+	}
+
+	d, err := DecimalFromFloat(big.NewFloat(0.1), 3)
+	if err != nil || d.String() != "0.100" {
+		t.Errorf("Invalid decimal from float: %s %v", d, err)
+	}
+	if _, err := DecimalFromFloat(new(big.Float).SetInf(false), 3); err == nil {
+		t.Errorf("Expected an error for an infinite float")
+	}
+}
+
+func TestDecimalScan(t *testing.T) {
+	tcs := []struct {
+		src      interface{}
+		expected string
+	}{
+		{NewDecimal(1, 1), "0.1"},
+		{"12.30", "12.30"},
+		{[]byte("-4.5"), "-4.5"},
+		{int64(42), "42"},
+		{int32(-3), "-3"},
+		{float64(2.5), "2.5"},
+	}
+
+	for _, tc := range tcs {
+		var d Decimal
+		if err := d.Scan(tc.src); err != nil || d.String() != tc.expected {
+			t.Errorf("Invalid scan of %v: %s %v", tc.src, d, err)
+		}
+	}
+
+	var d Decimal
+	if err := d.Scan(nil); err == nil {
+		t.Errorf("Expected an error for NULL")
+	}
+	if s, err := convertToMonet(NewDecimal(-5, 3)); err != nil || s != "-0.005" {
+		t.Errorf("Invalid literal: %s %v", s, err)
+	}
+}
+
+func TestDecimalResults(t *testing.T) {
+	var mu sync.Mutex
+	var args string
+	s := newFakeServer(t, func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(cmd, "sPREPARE "):
+			return "&5 1 1 6 1\n"
+		case strings.HasPrefix(cmd, "sEXEC 1 ("):
+			args = cmd
+			return "&1 2 1 1 1\n% sys.t # table_name\n% a # name\n% decimal # type\n" +
+				"% 20 # length\n% 18 4 # typesizes\n[ 12345678901234.5678\t]\n"
+		}
+		return "&2 0 -1\n"
+	})
+	defer s.Close()
+
+	tcs := []struct {
+		option   string
+		expected interface{}
+	}{
+		{"", float64(12345678901234.5678)},
+		{"?decimal=exact", "12345678901234.5678"},
+		{"?decimal=string", "12345678901234.5678"},
+		{"?decimal=float64", float64(12345678901234.5678)},
+	}
+
+	for _, tc := range tcs {
+		db, err := sql.Open("monetdb", s.dsn()+tc.option)
+		if err != nil {
+			t.Fatalf("Error opening database: %v", err)
+		}
+
+		var v interface{}
+		err = db.QueryRowContext(context.Background(), "SELECT a FROM t WHERE a > ?", NewDecimal(10005, 4)).Scan(&v)
+		db.Close()
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", tc.option, err)
+			continue
+		}
+
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		if d, ok := v.(Decimal); ok {
+			v = d.String()
+			if tc.option == "?decimal=string" {
+				t.Errorf("Unexpected Decimal for %s", tc.option)
+			}
+		}
+		if v != tc.expected {
+			t.Errorf("Invalid value for %s: %#v, expected: %#v", tc.option, v, tc.expected)
+		}
+	}
+
+	mu.Lock()
+	if args != "sEXEC 1 (1.0005);" {
+		t.Errorf("Invalid arguments: %s", args)
+	}
+	mu.Unlock()
+
+	// the default can be scanned like the float64 of earlier versions
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	var f float64
+	var ns sql.NullString
+	if err := db.QueryRow("SELECT a FROM t WHERE a > ?", 1).Scan(&f); err != nil || f != 12345678901234.5678 {
+		t.Errorf("Invalid value: %v, %v", f, err)
+	}
+	if err := db.QueryRow("SELECT a FROM t WHERE a > ?", 1).Scan(&ns); err != nil || !ns.Valid {
+		t.Errorf("Invalid value: %v, %v", ns, err)
+	}
+
+	if _, err := ParseDSN("localhost/demo?decimal=big"); err == nil {
+		t.Errorf("Expected an error for an invalid decimal mode")
+	}
+}
@@ -6,12 +6,15 @@
 
 Package monetdb contains a database driver for MonetDB.
 
-Use the following format for the Data Source Name (DSN) to make connection
-to the MonetDB server.
+Use one of the following formats for the Data Source Name (DSN) to make
+connection to the MonetDB server.
 
-    [username[:password]@]hostname[:port]/database
+    monetdb://[username[:password]@]hostname[:port]/database[?options]
+    [username[:password]@]hostname[:port]/database[?options]
 
 If the port is not specified, then the default port 50000 will be used.
+The options are given as a query string, for example
+schema=sys&timezone=+02:00&replysize=1000&autocommit=false.
 
 Please check the project's GitHub page for more complete documentation -
 https://github.com/fajran/go-monetdb
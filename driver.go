@@ -5,11 +5,9 @@
 package monetdb
 
 import (
+	"context"
 	"database/sql"
 	"database/sql/driver"
-	"fmt"
-	"regexp"
-	"strconv"
 )
 
 func init() {
@@ -19,47 +17,23 @@ func init() {
 type Driver struct {
 }
 
-type config struct {
-	Username string
-	Password string
-	Hostname string
-	Database string
-	Port     int
-}
-
 func (*Driver) Open(name string) (driver.Conn, error) {
-	c, err := parseDSN(name)
+	c, err := ParseDSN(name)
 	if err != nil {
 		return nil, err
 	}
-	return newConn(c)
+	return newConn(context.Background(), c)
 }
 
-func parseDSN(name string) (config, error) {
-	re := regexp.MustCompile(`^((?P<username>[^:]+?)(:(?P<password>[^@]+?))?@)?(?P<hostname>[a-zA-Z0-9.]+?)(:(?P<port>\d+?))?/(?P<database>.+?)$`)
-	if !re.MatchString(name) {
-		return config{}, fmt.Errorf("Invalid DSN")
+func (*Driver) OpenConnector(name string) (driver.Connector, error) {
+	c, err := ParseDSN(name)
+	if err != nil {
+		return nil, err
 	}
-	m := re.FindAllStringSubmatch(name, -1)[0]
-	n := re.SubexpNames()
 
-	c := config{
-		Hostname: "localhost",
-		Port:     50000,
-	}
-	for i, v := range m {
-		if n[i] == "username" {
-			c.Username = v
-		} else if n[i] == "password" {
-			c.Password = v
-		} else if n[i] == "hostname" {
-			c.Hostname = v
-		} else if n[i] == "port" && v != "" {
-			c.Port, _ = strconv.Atoi(v)
-		} else if n[i] == "database" {
-			c.Database = v
-		}
+	connector, err := NewConnector(c)
+	if err != nil {
+		return nil, err
 	}
-
-	return c, nil
+	return connector, nil
 }
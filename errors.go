@@ -0,0 +1,156 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The classes of errors, to be used with errors.Is:
+//
+//	if errors.Is(err, monetdb.ErrConflict) {
+//		// retry the transaction
+//	}
+var (
+	// ErrSyntax is a syntax error or access rule violation, SQLSTATE
+	// class 42.
+	ErrSyntax = errors.New("Syntax error or access rule violation")
+
+	// ErrConstraint is a constraint violation, SQLSTATE class 23 or
+	// 40002, which MonetDB uses for a violation at commit.
+	ErrConstraint = errors.New("Constraint violation")
+
+	// ErrConflict is a transaction that is aborted because of a
+	// concurrent transaction, SQLSTATE class 40.
+	ErrConflict = errors.New("Transaction conflict")
+
+	// ErrAuth is a failed login, SQLSTATE class 28.
+	ErrAuth = errors.New("Authentication failed")
+
+	// ErrConnectionLost is a connection that failed, SQLSTATE class 08.
+	// The connection can't be used any more.
+	ErrConnectionLost = errors.New("Connection lost")
+)
+
+const (
+	sqlStateAuth           = "28000"
+	sqlStateConnectionLost = "08006"
+	sqlStateConstraint     = "40002"
+)
+
+// Error is an error reported by the server, or the loss of the
+// connection to it.
+type Error struct {
+	// Code is the SQLSTATE of the error. It is empty when the server
+	// didn't send one.
+	Code string
+
+	// Message is the first error message.
+	Message string
+
+	// Detail holds the messages of any further error lines, with
+	// their SQLSTATE.
+	Detail []string
+
+	// err is the error that caused a lost connection.
+	err error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	if e.Code == sqlStateConnectionLost {
+		b.WriteString("Connection lost")
+	} else {
+		b.WriteString("Database error")
+	}
+	if e.Code != "" {
+		fmt.Fprintf(&b, " %s", e.Code)
+	}
+	fmt.Fprintf(&b, ": %s", e.Message)
+	for _, d := range e.Detail {
+		fmt.Fprintf(&b, "\n%s", d)
+	}
+	return b.String()
+}
+
+// Unwrap returns the error that caused a lost connection.
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether the error belongs to the class of target, which is
+// one of ErrSyntax, ErrConstraint, ErrConflict, ErrAuth and
+// ErrConnectionLost.
+func (e *Error) Is(target error) bool {
+	class := ""
+	if len(e.Code) == 5 {
+		class = e.Code[:2]
+	}
+
+	switch target {
+	case ErrSyntax:
+		return class == "42"
+	case ErrConstraint:
+		return class == "23" || e.Code == sqlStateConstraint
+	case ErrConflict:
+		return class == "40" && e.Code != sqlStateConstraint
+	case ErrAuth:
+		return class == "28"
+	case ErrConnectionLost:
+		return class == "08"
+	}
+	return false
+}
+
+// parseError parses an error line, without the leading '!'. The line
+// starts with a SQLSTATE when the server sent one, as in
+//
+//	42S02!SELECT: no such table 'x'
+func parseError(line string) *Error {
+	line = strings.TrimSpace(line)
+	if len(line) > 5 && line[5] == '!' && isSQLState(line[:5]) {
+		return &Error{Code: line[:5], Message: line[6:]}
+	}
+	return &Error{Message: line}
+}
+
+// parseErrors parses the error lines of a response into a single Error.
+// It returns nil when there are none.
+func parseErrors(response string) *Error {
+	var e *Error
+	for _, line := range strings.Split(response, "\n") {
+		if strings.HasPrefix(line, mapi_MSG_ERROR) {
+			e = e.add(line[1:])
+		}
+	}
+	return e
+}
+
+// add adds an error line to the error, or returns a new one for the
+// first line.
+func (e *Error) add(line string) *Error {
+	if e == nil {
+		return parseError(line)
+	}
+	e.Detail = append(e.Detail, strings.TrimSpace(line))
+	return e
+}
+
+// connectionLost returns the error for a connection that failed because
+// of err.
+func connectionLost(err error) *Error {
+	return &Error{Code: sqlStateConnectionLost, Message: err.Error(), err: err}
+}
+
+func isSQLState(code string) bool {
+	for _, r := range code {
+		if (r < '0' || r > '9') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	tcs := []struct {
+		response string
+		expected *Error
+		message  string
+	}{
+		{"!42S02!SELECT: no such table 'x'\n",
+			&Error{Code: "42S02", Message: "SELECT: no such table 'x'"},
+			"Database error 42S02: SELECT: no such table 'x'"},
+		{"!no code here\n",
+			&Error{Message: "no code here"},
+			"Database error: no code here"},
+		{"!40000!COMMIT: transaction is aborted\n!40000!ROLLBACK instead\n",
+			&Error{Code: "40000", Message: "COMMIT: transaction is aborted", Detail: []string{"40000!ROLLBACK instead"}},
+			"Database error 40000: COMMIT: transaction is aborted\n40000!ROLLBACK instead"},
+		{"#info\n!M0M29!INSERT INTO: PRIMARY KEY constraint violated\n",
+			&Error{Code: "M0M29", Message: "INSERT INTO: PRIMARY KEY constraint violated"},
+			"Database error M0M29: INSERT INTO: PRIMARY KEY constraint violated"},
+		{"!4200!too short\n",
+			&Error{Message: "4200!too short"},
+			"Database error: 4200!too short"},
+	}
+
+	for _, tc := range tcs {
+		e := parseErrors(tc.response)
+		if !reflect.DeepEqual(e, tc.expected) {
+			t.Errorf("Invalid error for %q: %#v, expected: %#v", tc.response, e, tc.expected)
+			continue
+		}
+		if e.Error() != tc.message {
+			t.Errorf("Invalid message for %q: %s, expected: %s", tc.response, e.Error(), tc.message)
+		}
+	}
+
+	if e := parseErrors("&2 1 -1\n"); e != nil {
+		t.Errorf("Unexpected error: %v", e)
+	}
+}
+
+func TestErrorClasses(t *testing.T) {
+	classes := []error{ErrSyntax, ErrConstraint, ErrConflict, ErrAuth, ErrConnectionLost}
+
+	tcs := []struct {
+		err   error
+		class error
+	}{
+		{&Error{Code: "42000"}, ErrSyntax},
+		{&Error{Code: "42S02"}, ErrSyntax},
+		{&Error{Code: "23000"}, ErrConstraint},
+		{&Error{Code: "40002"}, ErrConstraint},
+		{&Error{Code: "40000"}, ErrConflict},
+		{&Error{Code: "40001"}, ErrConflict},
+		{&Error{Code: "28000"}, ErrAuth},
+		{connectionLost(io.ErrUnexpectedEOF), ErrConnectionLost},
+		{&Error{Code: "M0M29"}, nil},
+		{&Error{}, nil},
+	}
+
+	for _, tc := range tcs {
+		for _, class := range classes {
+			if errors.Is(tc.err, class) != (class == tc.class) {
+				t.Errorf("Invalid class of %v: is %v is %v", tc.err, class, !(class == tc.class))
+			}
+		}
+	}
+
+	if !errors.Is(connectionLost(io.ErrUnexpectedEOF), io.ErrUnexpectedEOF) {
+		t.Errorf("The cause of a lost connection is not unwrapped")
+	}
+}
+
+func TestErrorsFromServer(t *testing.T) {
+	s := newFakeServer(t, func(cmd string) string {
+		switch {
+		case cmd == "sPREPARE COMMIT;":
+			return "&5 3 0 6 0\n"
+		case strings.HasPrefix(cmd, "sEXEC 3 "):
+			return "!40000!COMMIT: transaction is aborted because of concurrency conflicts\n!40000!will ROLLBACK instead\n"
+		case cmd == "Xreply_size 10":
+			return "!42000!Xreply_size: invalid size\n"
+		}
+		return "&2 1 -1\n"
+	})
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	_, err = c.ExecContext(context.Background(), "COMMIT", nil)
+	var e *Error
+	if !errors.As(err, &e) || !errors.Is(err, ErrConflict) {
+		t.Fatalf("Invalid error: %#v", err)
+	}
+	if e.Code != "40000" || len(e.Detail) != 1 {
+		t.Errorf("Invalid error: %#v", e)
+	}
+
+	_, err = c.mapi.Cmd("Xreply_size 10")
+	if !errors.As(err, &e) || !errors.Is(err, ErrSyntax) {
+		t.Errorf("Invalid error: %#v", err)
+	}
+
+	// the connection is still usable after an error
+	if _, err := c.ExecContext(context.Background(), "UPDATE t SET a = 1", nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestLoginError(t *testing.T) {
+	s := newFakeMerovingian(t, func(response string) string {
+		return "!InvalidCredentialsException:checkCredentials:invalid credentials for user 'monetdb'\n"
+	}, updateHandler)
+	defer s.Close()
+
+	_, err := openTestConn(t, s.dsn())
+	var e *Error
+	if !errors.As(err, &e) || !errors.Is(err, ErrAuth) {
+		t.Errorf("Invalid error: %#v", err)
+	}
+}
+
+func TestConnectionLost(t *testing.T) {
+	s := newFakeServer(t, func(cmd string) string {
+		return "&2 1 -1\n"
+	})
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	s.Close()
+
+	_, err = c.ExecContext(context.Background(), "UPDATE t SET a = 1", nil)
+	if !errors.Is(err, ErrConnectionLost) {
+		t.Errorf("Invalid error: %#v", err)
+	}
+}
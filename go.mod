@@ -0,0 +1,3 @@
+module github.com/fajran/go-monetdb
+
+go 1.24
@@ -0,0 +1,145 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"crypto"
+	_ "crypto/md5"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha3"
+	_ "crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+)
+
+// hashAlgorithm is a hash algorithm that can be used to log in, under
+// the name that the server uses for it.
+type hashAlgorithm struct {
+	name string
+
+	// hash is used unless new is set by RegisterHash
+	hash crypto.Hash
+	new  func() hash.Hash
+}
+
+func (a hashAlgorithm) available() bool {
+	return a.new != nil || a.hash.Available()
+}
+
+func (a hashAlgorithm) New() hash.Hash {
+	if a.new != nil {
+		return a.new()
+	}
+	return a.hash.New()
+}
+
+var (
+	hashLock sync.RWMutex
+
+	// hashRegistry holds the supported algorithms, strongest first.
+	// Others, such as RIPEMD160, can be added with RegisterHash.
+	hashRegistry = []hashAlgorithm{
+		{name: "SHA3-512", hash: crypto.SHA3_512},
+		{name: "SHA512", hash: crypto.SHA512},
+		{name: "SHA3-384", hash: crypto.SHA3_384},
+		{name: "SHA384", hash: crypto.SHA384},
+		{name: "SHA3-256", hash: crypto.SHA3_256},
+		{name: "SHA256", hash: crypto.SHA256},
+		{name: "SHA3-224", hash: crypto.SHA3_224},
+		{name: "SHA224", hash: crypto.SHA224},
+		{name: "SHA1", hash: crypto.SHA1},
+		{name: "MD5", hash: crypto.MD5},
+	}
+)
+
+// RegisterHash makes a hash algorithm available to log in, under the
+// name that the server uses for it. It is preferred over the algorithms
+// that are already registered, and replaces one with the same name.
+func RegisterHash(name string, new func() hash.Hash) {
+	hashLock.Lock()
+	defer hashLock.Unlock()
+
+	registry := []hashAlgorithm{{name: name, new: new}}
+	for _, a := range hashRegistry {
+		if a.name != name {
+			registry = append(registry, a)
+		}
+	}
+	hashRegistry = registry
+}
+
+// DeregisterHash removes a hash algorithm registered under the given name.
+func DeregisterHash(name string) {
+	hashLock.Lock()
+	defer hashLock.Unlock()
+
+	registry := make([]hashAlgorithm, 0, len(hashRegistry))
+	for _, a := range hashRegistry {
+		if a.name != name {
+			registry = append(registry, a)
+		}
+	}
+	hashRegistry = registry
+}
+
+// getHash returns the available algorithm with the given name.
+func getHash(name string) (hashAlgorithm, bool) {
+	hashLock.RLock()
+	defer hashLock.RUnlock()
+
+	for _, a := range hashRegistry {
+		if a.name == name && a.available() {
+			return a, true
+		}
+	}
+	return hashAlgorithm{}, false
+}
+
+// selectHash returns the strongest available algorithm of the given
+// comma separated list.
+func selectHash(names string) (hashAlgorithm, bool) {
+	offered := "," + names + ","
+
+	hashLock.RLock()
+	defer hashLock.RUnlock()
+
+	for _, a := range hashRegistry {
+		if strings.Contains(offered, ","+a.name+",") && a.available() {
+			return a, true
+		}
+	}
+	return hashAlgorithm{}, false
+}
+
+// HashPassword returns the password hashed with the given algorithm, as
+// {ALGORITHM}hexdigits. The server announces the algorithm that it uses
+// for passwords, which is SHA512 by default.
+//
+// Set the result as the PasswordHash of a Config, so the password
+// itself doesn't need to be kept.
+func HashPassword(algorithm, password string) (string, error) {
+	a, ok := getHash(algorithm)
+	if !ok {
+		return "", fmt.Errorf("Unsupported algorithm: %s", algorithm)
+	}
+
+	h := a.New()
+	io.WriteString(h, password)
+	return fmt.Sprintf("{%s}%x", a.name, h.Sum(nil)), nil
+}
+
+// splitPasswordHash splits a hash that is returned by HashPassword into
+// its algorithm and hex digits.
+func splitPasswordHash(s string) (string, string, error) {
+	end := strings.Index(s, "}")
+	if !strings.HasPrefix(s, "{") || end < 0 {
+		return "", "", fmt.Errorf("Invalid password hash, expected {ALGORITHM}hexdigits")
+	}
+	return s[1:end], strings.ToLower(s[end+1:]), nil
+}
@@ -0,0 +1,134 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	sha512Password  = "{SHA512}a73f1d86383446438ac64f56e15ada38b41fbb18f029d2181723aeb2acac6a831f60e5fdbd64ac2c8c70e035dd44cbbe3b45565ef2d58feb2821a2078c7fad35"
+	sha384Password  = "{SHA384}d494cbc91a0d3315210af1c2d14e3758ba7d6716393a234cf9f29d8de077110c9009dd840f9c93a5d350b739253f6bd9"
+	sha3512Password = "{SHA3-512}1380a1fb7a9b87eef9b3a887e7ce14426e51512b911fd51cd392d02ece6ffbf7a5fcf16c11f1b3ec0e166e23ef7be49689bb7978d87e90e0e5f2d62b844d8048"
+)
+
+func TestChallengeResponse(t *testing.T) {
+	tcs := []struct {
+		challenge string
+		hash      string
+	}{
+		{"s4lt:mserver:9:SHA1,MD5:LIT:SHA512:",
+			"{SHA1}361f15d588e40bc167b079237bc72fd960bb78f6"},
+		{"s4lt:mserver:9:MD5:LIT:SHA512:",
+			"{MD5}cfb11a870167c18aaf5122aafd286458"},
+		{"s4lt:mserver:9:RIPEMD160,SHA256,SHA1,MD5:LIT:SHA512:",
+			"{SHA256}3e940bdebba384e92a8565a4079858201497af88952575fef136bd9c8e1a7169"},
+		{"s4lt:mserver:9:SHA224,SHA3-224:LIT:SHA512:",
+			"{SHA3-224}29732f0a9e6db52998aa898a096fc7426216be091bac4ce0b8cd4770"},
+		{"s4lt:mserver:9:SHA1,SHA512,SHA384,SHA3-256:LIT:SHA512:",
+			"{SHA512}bc7620de3a28b29b99860528403770ea83346eda37cdc4e9fb1565c612d107628b611a0afa0ab04ed7f1905e51e9fcdef4e844eed4341ad95cdc4b5d4fc8564f"},
+		{"s4lt:mserver:9:SHA3-384,SHA384,SHA256:BIG:SHA384:",
+			"{SHA3-384}d8a187391f2ae22f4dcf911e831e01f9a3d834c7733db1fa66acf9bab44545e5b95a4837613472c34dad9f0ecacd2380"},
+		{"s4lt:mserver:9:SHA3-512,SHA512:LIT:SHA3-512:sql=6:",
+			"{SHA3-512}d786aa522ffc21f49a31715142192cb5fc37b396a7ac76f2e5a40d838444056d3ad1d4de274bf9e03655408784825102fd37246ac87b221ee94e50401b6c8728"},
+	}
+
+	for _, tc := range tcs {
+		expected := fmt.Sprintf("BIG:monetdb:%s:sql:demo:", tc.hash)
+
+		c := NewMapi("localhost", 50000, "monetdb", "monetdb", "demo", "sql")
+		r, err := c.challengeResponse([]byte(tc.challenge))
+		if err != nil || r != expected {
+			t.Errorf("Invalid response for %s: %s %v, expected: %s", tc.challenge, r, err, expected)
+		}
+
+		// the same response follows from the hashed password
+		algorithm := strings.Split(tc.challenge, ":")[5]
+		c = NewMapi("localhost", 50000, "monetdb", "", "demo", "sql")
+		c.PasswordHash, err = HashPassword(algorithm, "monetdb")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		r, err = c.challengeResponse([]byte(tc.challenge))
+		if err != nil || r != expected {
+			t.Errorf("Invalid response for %s: %s %v, expected: %s", tc.challenge, r, err, expected)
+		}
+	}
+}
+
+func TestChallengeResponseErrors(t *testing.T) {
+	tcs := []struct {
+		challenge    string
+		passwordHash string
+		err          string
+	}{
+		{"s4lt:mserver:8:SHA1:LIT:SHA512:", "", "We only speak protocol v9"},
+		{"", "", "Invalid challenge"},
+		{"s4lt:mserver:9", "", "Invalid challenge"},
+		{"s4lt:mserver:9:SHA1:LIT", "", "Invalid challenge"},
+		{"s4lt:mserver:9:SHA1:LIT:WHIRLPOOL:", "", "Unsupported algorithm: WHIRLPOOL"},
+		{"s4lt:mserver:9:CRC32:LIT:SHA512:", "", "Unsupported hash algorithm required for login CRC32"},
+		{"s4lt:mserver:9:SHA1:LIT:SHA512:", sha384Password, "Password hash uses SHA384, the server requires SHA512"},
+		{"s4lt:mserver:9:SHA1:LIT:SHA512:", "a73f1d86", "Invalid password hash"},
+	}
+
+	for _, tc := range tcs {
+		c := NewMapi("localhost", 50000, "monetdb", "monetdb", "demo", "sql")
+		c.PasswordHash = tc.passwordHash
+		_, err := c.challengeResponse([]byte(tc.challenge))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("Invalid error for %s: %v, expected: %s", tc.challenge, err, tc.err)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	tcs := []struct {
+		algorithm string
+		expected  string
+	}{
+		{"SHA512", sha512Password},
+		{"SHA384", sha384Password},
+		{"SHA3-512", sha3512Password},
+	}
+
+	for _, tc := range tcs {
+		h, err := HashPassword(tc.algorithm, "monetdb")
+		if err != nil || h != tc.expected {
+			t.Errorf("Invalid hash for %s: %s %v, expected: %s", tc.algorithm, h, err, tc.expected)
+		}
+	}
+
+	if _, err := HashPassword("WHIRLPOOL", "monetdb"); err == nil {
+		t.Errorf("Expected an error for an unsupported algorithm")
+	}
+}
+
+func TestRegisterHash(t *testing.T) {
+	RegisterHash("FNV128A", fnv.New128a)
+	defer DeregisterHash("FNV128A")
+
+	h := fnv.New128a()
+	io.WriteString(h, strings.TrimPrefix(sha512Password, "{SHA512}"))
+	io.WriteString(h, "s4lt")
+	expected := fmt.Sprintf("BIG:monetdb:{FNV128A}%x:sql:demo:", h.Sum(nil))
+
+	// a registered algorithm is preferred over the built-in ones
+	c := NewMapi("localhost", 50000, "monetdb", "monetdb", "demo", "sql")
+	r, err := c.challengeResponse([]byte("s4lt:mserver:9:SHA512,FNV128A:LIT:SHA512:"))
+	if err != nil || r != expected {
+		t.Errorf("Invalid response: %s %v, expected: %s", r, err, expected)
+	}
+
+	DeregisterHash("FNV128A")
+	r, err = c.challengeResponse([]byte("s4lt:mserver:9:SHA512,FNV128A:LIT:SHA512:"))
+	if err != nil || !strings.Contains(r, "{SHA512}") {
+		t.Errorf("Invalid response: %s %v", r, err)
+	}
+}
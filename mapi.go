@@ -5,18 +5,19 @@
 package monetdb
 
 import (
+	"bufio"
 	"bytes"
-	"crypto"
-	_ "crypto/md5"
-	_ "crypto/sha1"
-	_ "crypto/sha512"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
-	"hash"
 	"io"
 	"net"
+	"net/url"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -36,6 +37,8 @@ const (
 	mapi_MSG_TUPLE    = "["
 	mapi_MSG_REDIRECT = "^"
 	mapi_MSG_OK       = "=OK"
+
+	mapi_MAX_REDIRECTS = 10
 )
 
 // MAPI connection is established.
@@ -44,6 +47,12 @@ const MAPI_STATE_READY = 1
 // MAPI connection is NOT established.
 const MAPI_STATE_INIT = 0
 
+// SocketPath returns the path of the Unix domain socket that a MonetDB
+// server listening on the given port creates in dir, usually /tmp.
+func SocketPath(dir string, port int) string {
+	return filepath.Join(dir, fmt.Sprintf(".s.monetdb.%d", port))
+}
+
 var (
 	mapi_MSG_MORE = string([]byte{1, 2, 10})
 )
@@ -56,18 +65,52 @@ var (
 // The final values are available after the connection is made by
 // calling the Connect() function.
 //
+// When Socket is set, the connection is made through that Unix domain
+// socket instead of Hostname and Port.
+//
 // The State value can be either MAPI_STATE_INIT or MAPI_STATE_READY.
 type MapiConn struct {
 	Hostname string
 	Port     int
+	Socket   string
 	Username string
 	Password string
 	Database string
 	Language string
 
+	// PasswordHash is used instead of the Password when it is set, see
+	// HashPassword.
+	PasswordHash string
+
+	// TLSConfig enables TLS when it is not nil. When its ServerName is
+	// empty, the Hostname is used to verify the server's certificate.
+	TLSConfig *tls.Config
+
+	// Dialer opens the network connection. When it is nil, a net.Dialer
+	// is used.
+	Dialer Dialer
+
+	// Logger receives the informational messages of the server.
+	Logger Logger
+
+	// UploadHandler and DownloadHandler handle the file transfers of
+	// COPY ... ON CLIENT. The server's requests are refused when they
+	// are nil.
+	UploadHandler   UploadHandler
+	DownloadHandler DownloadHandler
+
 	State int
 
-	conn *net.TCPConn
+	// byteOrder is the byte order of the server, and binaryLevel the
+	// level of the binary result set protocol it supports, zero when it
+	// doesn't.
+	byteOrder   binary.ByteOrder
+	binaryLevel int
+
+	conn   net.Conn
+	blocks *blockReader
+	reader *bufio.Reader
+	line   []byte
 }
 
 // NewMapi returns a MonetDB's MAPI connection handle.
@@ -86,6 +129,24 @@ func NewMapi(hostname string, port int, username, password, database, language s
 	}
 }
 
+// copy returns a new, unconnected handle with the same settings.
+func (c *MapiConn) copy() *MapiConn {
+	m := NewMapi(c.Hostname, c.Port, c.Username, c.Password, c.Database, c.Language)
+	m.Socket = c.Socket
+	m.PasswordHash = c.PasswordHash
+	m.TLSConfig = c.TLSConfig
+	m.Dialer = c.Dialer
+	m.Logger = c.Logger
+	return m
+}
+
+// logf passes a message to the Logger, if there is one.
+func (c *MapiConn) logf(format string, v ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, v...)
+	}
+}
+
 // Disconnect closes the connection.
 func (c *MapiConn) Disconnect() {
 	c.State = MAPI_STATE_INIT
@@ -95,22 +156,33 @@ func (c *MapiConn) Disconnect() {
 	}
 }
 
-// Cmd sends a MAPI command to MonetDB.
-func (c *MapiConn) Cmd(operation string) (string, error) {
-	if c.State != MAPI_STATE_READY {
-		return "", fmt.Errorf("Database not connected")
+// SetDeadline sets the read and write deadline of the underlying socket.
+// A zero value for t means I/O operations will not time out.
+func (c *MapiConn) SetDeadline(t time.Time) error {
+	if c.conn == nil {
+		return fmt.Errorf("Database not connected")
 	}
+	return c.conn.SetDeadline(t)
+}
 
-	if err := c.putBlock([]byte(operation)); err != nil {
+// Cmd sends a MAPI command to MonetDB.
+//
+// An error of the server is returned even when it follows the results of
+// earlier statements or info lines, in which case the response is
+// returned as well.
+//
+// When the command fails because of a network error, the connection is
+// moved back to MAPI_STATE_INIT as the rest of the response is lost.
+func (c *MapiConn) Cmd(operation string) (string, error) {
+	if err := c.send(operation); err != nil {
 		return "", err
 	}
 
-	r, err := c.getBlock()
+	resp, err := c.readResponse()
 	if err != nil {
 		return "", err
 	}
 
-	resp := string(r)
 	if len(resp) == 0 {
 		return "", nil
 
@@ -121,121 +193,411 @@ func (c *MapiConn) Cmd(operation string) (string, error) {
 		// tell server it isn't going to get more
 		return c.Cmd("")
 
-	} else if strings.HasPrefix(resp, mapi_MSG_Q) || strings.HasPrefix(resp, mapi_MSG_HEADER) || strings.HasPrefix(resp, mapi_MSG_TUPLE) {
+	} else if strings.HasPrefix(resp, mapi_MSG_Q) || strings.HasPrefix(resp, mapi_MSG_HEADER) || strings.HasPrefix(resp, mapi_MSG_TUPLE) || strings.HasPrefix(resp, mapi_MSG_INFO) {
+		if err := parseErrors(resp); err != nil {
+			return resp, err
+		}
 		return resp, nil
 
 	} else if strings.HasPrefix(resp, mapi_MSG_ERROR) {
-		return "", fmt.Errorf("Operational error: %s", resp[1:])
+		return "", parseErrors(resp)
 
 	} else {
+		// the connection is out of step with the server
+		c.State = MAPI_STATE_INIT
 		return "", fmt.Errorf("Unknown state: %s", resp)
 	}
 }
 
+// readResponse reads the rest of the response, and handles the file
+// transfers that the server requests in it. The error of a file transfer
+// is returned once the whole response has been read.
+func (c *MapiConn) readResponse() (string, error) {
+	var resp strings.Builder
+	var transferErr error
+	for {
+		r, err := io.ReadAll(c.reader)
+		if err != nil {
+			return "", c.readError(err)
+		}
+		if !strings.HasSuffix(string(r), mapi_MSG_FILETRANS) {
+			resp.Write(r)
+			return resp.String(), transferErr
+		}
+
+		// the request is the line before the prompt
+		lines := strings.TrimSuffix(string(r), mapi_MSG_FILETRANS)
+		i := strings.LastIndex(strings.TrimSuffix(lines, "\n"), "\n") + 1
+		resp.WriteString(lines[:i])
+		if err := c.fileTransfer(strings.TrimSuffix(lines[i:], "\n")); err != nil {
+			if c.State != MAPI_STATE_READY {
+				return "", err
+			}
+			if transferErr == nil {
+				transferErr = err
+			}
+		}
+	}
+}
+
 // Connect starts a MAPI connection to MonetDB server.
 func (c *MapiConn) Connect() error {
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext starts a MAPI connection to MonetDB server. The deadline
+// and cancellation of the context apply to connecting and logging in.
+//
+// The server may redirect the connection, to another server or back to
+// the login when it is a merovingian proxy. At most mapi_MAX_REDIRECTS
+// redirects are followed.
+func (c *MapiConn) ConnectContext(ctx context.Context) error {
 	if c.conn != nil {
 		c.conn.Close()
 		c.conn = nil
 	}
 
-	addr := fmt.Sprintf("%s:%d", c.Hostname, c.Port)
-	raddr, err := net.ResolveTCPAddr("tcp", addr)
+	w := &connectWatch{ctx: ctx}
+	err := c.connect(ctx, w)
+	if w.stop() && err != nil {
+		err = ctx.Err()
+	}
+
 	if err != nil {
+		c.Disconnect()
 		return err
 	}
+	c.conn.SetDeadline(time.Time{})
+
+	c.State = MAPI_STATE_READY
+	return nil
+}
+
+// connectWatch interrupts the connections that are opened while
+// connecting, once the context is done.
+type connectWatch struct {
+	ctx   context.Context
+	stops []func() bool
+}
+
+func (w *connectWatch) watch(conn net.Conn) {
+	w.stops = append(w.stops, context.AfterFunc(w.ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	}))
+}
+
+// stop ends the watch, and reports whether a connection was interrupted.
+func (w *connectWatch) stop() bool {
+	interrupted := false
+	for _, stop := range w.stops {
+		if !stop() {
+			interrupted = true
+		}
+	}
+	return interrupted
+}
 
-	conn, err := net.DialTCP("tcp", nil, raddr)
+// connect opens the connection and logs in, following the redirects of
+// the server.
+func (c *MapiConn) connect(ctx context.Context, w *connectWatch) error {
+	if err := c.open(ctx, w); err != nil {
+		return err
+	}
+
+	for redirects := 0; ; redirects++ {
+		targets, err := c.tryLogin(ctx)
+		if err != nil || len(targets) == 0 {
+			return err
+		}
+
+		if redirects == mapi_MAX_REDIRECTS {
+			return fmt.Errorf("Maximal number of redirects reached (%d)", mapi_MAX_REDIRECTS)
+		}
+
+		if targets[0].proxy {
+			// the proxy restarts the login on the same connection
+			continue
+		}
+		if err := c.follow(ctx, w, targets); err != nil {
+			return err
+		}
+	}
+}
+
+// open dials Hostname and Port, or the Socket, and starts TLS when it is
+// enabled.
+func (c *MapiConn) open(ctx context.Context, w *connectWatch) error {
+	var err error
+	if c.Socket != "" {
+		err = c.dialUnix(ctx)
+	} else {
+		err = c.dialTCP(ctx)
+	}
 	if err != nil {
 		return err
 	}
+	w.watch(c.conn)
+
+	if c.TLSConfig != nil {
+		return c.startTLS(ctx)
+	}
+	return nil
+}
 
-	conn.SetKeepAlive(false)
-	conn.SetNoDelay(true)
+func (c *MapiConn) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	d := c.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	return d.DialContext(ctx, network, address)
+}
+
+// dialTCP connects to Hostname and Port.
+func (c *MapiConn) dialTCP(ctx context.Context) error {
+	addr := net.JoinHostPort(c.Hostname, strconv.Itoa(c.Port))
+	conn, err := c.dial(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetKeepAlive(false)
+		tcp.SetNoDelay(true)
+	}
 	c.conn = conn
+	return nil
+}
 
-	err = c.login()
+// dialUnix connects to the Unix domain socket in Socket.
+func (c *MapiConn) dialUnix(ctx context.Context) error {
+	conn, err := c.dial(ctx, "unix", c.Socket)
 	if err != nil {
 		return err
 	}
 
+	// The server expects a single '0' byte before the login on a
+	// Unix socket, it would otherwise wait for a file descriptor.
+	if _, err := conn.Write([]byte{'0'}); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.conn = conn
 	return nil
 }
 
-// login starts the login sequence
-func (c *MapiConn) login() error {
-	return c.tryLogin(0)
+// startTLS performs the TLS handshake on the connection.
+func (c *MapiConn) startTLS(ctx context.Context) error {
+	config := c.TLSConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = c.Hostname
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{mapiALPN}
+	}
+
+	conn := tls.Client(c.conn, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+
+	c.conn = conn
+	return nil
 }
 
-// tryLogin performs the login activity
-func (c *MapiConn) tryLogin(iteration int) error {
+// follow connects to the first of the redirect targets that can be
+// reached. The other targets are alternatives that the server offered.
+func (c *MapiConn) follow(ctx context.Context, w *connectWatch, targets []redirect) error {
+	c.conn.Close()
+	c.conn = nil
+
+	var err error
+	for _, r := range targets {
+		if r.proxy {
+			continue
+		}
+
+		c.Socket = r.socket
+		if r.socket == "" {
+			c.Hostname = r.hostname
+			c.Port = r.port
+		}
+		if r.database != "" {
+			c.Database = r.database
+		}
+		if r.tls && c.TLSConfig == nil {
+			c.TLSConfig = &tls.Config{}
+		}
+
+		err = c.open(ctx, w)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		c.logf("Redirect to %s failed: %v", r.uri, err)
+	}
+
+	if err == nil {
+		err = fmt.Errorf("Invalid redirect to a proxy")
+	}
+	return err
+}
+
+// tryLogin performs the login activity. When the server redirects the
+// connection, the targets of the redirect are returned.
+func (c *MapiConn) tryLogin(ctx context.Context) ([]redirect, error) {
 	challenge, err := c.getBlock()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	response, err := c.challengeResponse(challenge)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	c.putBlock([]byte(response))
+	if err := c.putBlock([]byte(response)); err != nil {
+		return nil, err
+	}
 
 	bprompt, err := c.getBlock()
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	prompt := strings.TrimSpace(string(bprompt))
-	if len(prompt) == 0 {
-		// Empty response, server is happy
+	var targets []redirect
+	var loginErr *Error
+	for _, prompt := range strings.Split(string(bprompt), "\n") {
+		prompt = strings.TrimSpace(prompt)
 
-	} else if prompt == mapi_MSG_OK {
-		// pass
+		if len(prompt) == 0 {
+			// Empty response, server is happy
 
-	} else if strings.HasPrefix(prompt, mapi_MSG_INFO) {
-		// TODO log info
+		} else if prompt == mapi_MSG_OK {
+			// pass
 
-	} else if strings.HasPrefix(prompt, mapi_MSG_ERROR) {
-		// TODO log error
-		return fmt.Errorf("Database error: %s", prompt[1:])
+		} else if strings.HasPrefix(prompt, mapi_MSG_INFO) {
+			c.logf("%s", prompt[1:])
 
-	} else if strings.HasPrefix(prompt, mapi_MSG_REDIRECT) {
-		t := strings.Split(prompt, " ")
-		r := strings.Split(t[0][1:], ":")
+		} else if strings.HasPrefix(prompt, mapi_MSG_ERROR) {
+			loginErr = loginErr.add(prompt[1:])
 
-		if r[1] == "merovingian" {
-			// restart auth
-			if iteration <= 10 {
-				c.tryLogin(iteration + 1)
-			} else {
-				return fmt.Errorf("Maximal number of redirects reached (10)")
+		} else if strings.HasPrefix(prompt, mapi_MSG_REDIRECT) {
+			r, err := parseRedirect(prompt[1:])
+			if err != nil {
+				return nil, err
 			}
-
-		} else if r[1] == "monetdb" {
-			c.Hostname = r[2][2:]
-			t = strings.Split(r[3], "/")
-			port, _ := strconv.ParseInt(t[0], 10, 32)
-			c.Port = int(port)
-			c.Database = t[1]
-			c.conn.Close()
-			c.Connect()
+			targets = append(targets, r)
 
 		} else {
-			return fmt.Errorf("Unknown redirect: %s", prompt)
+			return nil, fmt.Errorf("Unknown state: %s", prompt)
 		}
-	} else {
-		return fmt.Errorf("Unknown state: %s", prompt)
 	}
 
-	c.State = MAPI_STATE_READY
+	if loginErr != nil {
+		if loginErr.Code == "" && strings.HasPrefix(loginErr.Message, "InvalidCredentialsException:") {
+			loginErr.Code = sqlStateAuth
+		}
+		return nil, loginErr
+	}
+	return targets, nil
+}
 
-	return nil
+// redirect is a target that the server redirected the connection to.
+type redirect struct {
+	uri string
+
+	// proxy is set for a merovingian proxy, which restarts the login
+	// on the same connection.
+	proxy bool
+
+	socket   string
+	hostname string
+	port     int
+	database string
+	tls      bool
+}
+
+// parseRedirect parses the target of a redirect, which has one of the
+// forms
+//
+//	mapi:merovingian://proxy?database=db
+//	mapi:monetdb://host:port/db
+//	mapi:monetdbs://host:port/db
+//	mapi:monetdb:///path/to/socket?database=db
+func parseRedirect(uri string) (redirect, error) {
+	r := redirect{uri: uri}
+	if !strings.HasPrefix(uri, "mapi:") {
+		return r, fmt.Errorf("Unknown redirect: %s", uri)
+	}
+
+	u, err := url.Parse(uri[len("mapi:"):])
+	if err != nil {
+		return r, fmt.Errorf("Invalid redirect: %s", uri)
+	}
+	r.database = u.Query().Get("database")
+
+	switch u.Scheme {
+	case "merovingian":
+		r.proxy = true
+		return r, nil
+	case "monetdbs":
+		r.tls = true
+	case "monetdb":
+	default:
+		return r, fmt.Errorf("Unknown redirect: %s", uri)
+	}
+
+	if u.Host == "" {
+		if u.Path == "" {
+			return r, fmt.Errorf("Invalid redirect: %s", uri)
+		}
+		r.socket = u.Path
+		return r, nil
+	}
+
+	r.hostname = u.Hostname()
+	r.port = 50000
+	if p := u.Port(); p != "" {
+		r.port, err = strconv.Atoi(p)
+		if err != nil {
+			return r, fmt.Errorf("Invalid redirect: %s", uri)
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		r.database = db
+	}
+	return r, nil
+}
+
+// hashPassword returns the hex digits of the password hashed with the
+// given algorithm, or of the PasswordHash when it is set.
+func (c *MapiConn) hashPassword(algorithm string) (string, error) {
+	var err error
+	p := c.PasswordHash
+	if p == "" {
+		p, err = HashPassword(algorithm, c.Password)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	name, digits, err := splitPasswordHash(p)
+	if err != nil {
+		return "", err
+	}
+	if name != algorithm {
+		return "", fmt.Errorf("Password hash uses %s, the server requires %s", name, algorithm)
+	}
+	return digits, nil
 }
 
 // challengeResponse produces a response given a challenge
 func (c *MapiConn) challengeResponse(challenge []byte) (string, error) {
+	// salt:server:protocol:hashes:endianness:algorithm:options...
 	t := strings.Split(string(challenge), ":")
+	if len(t) < 6 {
+		return "", fmt.Errorf("Invalid challenge: %q", challenge)
+	}
 	salt := t[0]
 	protocol := t[2]
 	hashes := t[3]
@@ -245,86 +607,175 @@ func (c *MapiConn) challengeResponse(challenge []byte) (string, error) {
 		return "", fmt.Errorf("We only speak protocol v9")
 	}
 
-	var h hash.Hash
-	if algo == "SHA512" {
-		h = crypto.SHA512.New()
-	} else {
-		// TODO support more algorithm
-		return "", fmt.Errorf("Unsupported algorithm: %s", algo)
-	}
-	io.WriteString(h, c.Password)
-	p := fmt.Sprintf("%x", h.Sum(nil))
-
-	shashes := "," + hashes + ","
-	var pwhash string
-	if strings.Contains(shashes, ",SHA1,") {
-		h = crypto.SHA1.New()
-		io.WriteString(h, p)
-		io.WriteString(h, salt)
-		pwhash = fmt.Sprintf("{SHA1}%x", h.Sum(nil))
-
-	} else if strings.Contains(shashes, ",MD5,") {
-		h = crypto.MD5.New()
-		io.WriteString(h, p)
-		io.WriteString(h, salt)
-		pwhash = fmt.Sprintf("{MD5}%x", h.Sum(nil))
+	c.byteOrder = binary.LittleEndian
+	if t[4] == "BIG" {
+		c.byteOrder = binary.BigEndian
+	}
+	c.binaryLevel = 0
+	for _, option := range t[6:] {
+		if strings.HasPrefix(option, "BINARY=") {
+			c.binaryLevel, _ = strconv.Atoi(option[len("BINARY="):])
+		}
+	}
 
-	} else {
+	p, err := c.hashPassword(algo)
+	if err != nil {
+		return "", err
+	}
+
+	a, ok := selectHash(hashes)
+	if !ok {
 		return "", fmt.Errorf("Unsupported hash algorithm required for login %s", hashes)
 	}
+	h := a.New()
+	io.WriteString(h, p)
+	io.WriteString(h, salt)
+	pwhash := fmt.Sprintf("{%s}%x", a.name, h.Sum(nil))
 
 	r := fmt.Sprintf("BIG:%s:%s:%s:%s:", c.Username, pwhash, c.Language, c.Database)
 	return r, nil
 }
 
-// getBlock retrieves a block of message
-func (c *MapiConn) getBlock() ([]byte, error) {
-	r := new(bytes.Buffer)
+// blockReader reads the data of one server response, which is sent as one
+// or more blocks. It returns io.EOF after the last block.
+type blockReader struct {
+	conn      net.Conn
+	remaining int
+	last      bool
+	header    [2]byte
+}
 
-	last := 0
-	for last != 1 {
-		flag, err := c.getBytes(2)
-		if err != nil {
-			return nil, err
+func (r *blockReader) Read(p []byte) (int, error) {
+	for r.remaining == 0 {
+		if r.last {
+			return 0, io.EOF
 		}
-
-		var unpacked uint16
-		buf := bytes.NewBuffer(flag)
-		err = binary.Read(buf, binary.LittleEndian, &unpacked)
-		if err != nil {
-			return nil, err
+		if _, err := io.ReadFull(r.conn, r.header[:]); err != nil {
+			return 0, unexpectedEOF(err)
 		}
+		unpacked := binary.LittleEndian.Uint16(r.header[:])
+		r.remaining = int(unpacked >> 1)
+		r.last = unpacked&1 == 1
+	}
+
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.conn.Read(p)
+	r.remaining -= n
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
 
-		length := unpacked >> 1
-		last = int(unpacked & 1)
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, as the end of the
+// connection is never the end of a response.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
 
-		d, err := c.getBytes(int(length))
-		if err != nil {
-			return nil, err
-		}
+// mapi_READ_BUFFER is the size of the buffer that responses are read through.
+const mapi_READ_BUFFER = 64 * 1024
 
-		r.Write(d)
+// nextResponse prepares the reader for the next response of the server.
+// The previous response must have been read completely.
+func (c *MapiConn) nextResponse() {
+	if c.blocks == nil || c.blocks.conn != c.conn {
+		c.blocks = &blockReader{conn: c.conn}
+		c.reader = bufio.NewReaderSize(c.blocks, mapi_READ_BUFFER)
 	}
+	c.blocks.remaining = 0
+	c.blocks.last = false
+	c.reader.Reset(c.blocks)
+}
 
-	return r.Bytes(), nil
+// getBlock retrieves a complete response
+func (c *MapiConn) getBlock() ([]byte, error) {
+	c.nextResponse()
+	return io.ReadAll(c.reader)
 }
 
-// getBytes reads the given amount of bytes
-func (c *MapiConn) getBytes(count int) ([]byte, error) {
-	r := make([]byte, count)
-	b := make([]byte, count)
+// send sends a command, after which its response can be read line by
+// line with readLine.
+func (c *MapiConn) send(operation string) error {
+	if c.State != MAPI_STATE_READY {
+		return fmt.Errorf("Database not connected")
+	}
 
-	read := 0
-	for read < count {
-		n, err := c.conn.Read(b)
-		if err != nil {
-			return nil, err
+	if err := c.putBlock([]byte(operation)); err != nil {
+		c.State = MAPI_STATE_INIT
+		return connectionLost(err)
+	}
+
+	c.nextResponse()
+	return nil
+}
+
+// peek returns the first byte of the next line of the response without
+// consuming it. It returns io.EOF at the end of the response.
+func (c *MapiConn) peek() (byte, error) {
+	b, err := c.reader.Peek(1)
+	if err != nil {
+		return 0, c.readError(err)
+	}
+	return b[0], nil
+}
+
+// readLine returns the next line of the response, without the newline.
+// It returns io.EOF at the end of the response.
+//
+// The returned slice points into the read buffer and is only valid until
+// the next read.
+func (c *MapiConn) readLine() ([]byte, error) {
+	line, err := c.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// a line that is longer than the buffer
+		c.line = append(c.line[:0], line...)
+		for err == bufio.ErrBufferFull {
+			line, err = c.reader.ReadSlice('\n')
+			c.line = append(c.line, line...)
 		}
-		copy(r[read:], b[:n])
-		read += n
+		line = c.line
 	}
 
-	return r, nil
+	if err == io.EOF && len(line) > 0 {
+		// the last line of a response may lack the newline
+		return line, nil
+	}
+	if err != nil {
+		return nil, c.readError(err)
+	}
+	return line[:len(line)-1], nil
+}
+
+// drain discards the rest of the response.
+func (c *MapiConn) drain() error {
+	if _, err := io.Copy(io.Discard, c.reader); err != nil {
+		return c.readError(err)
+	}
+	return nil
+}
+
+// invalidResponse moves the connection back to MAPI_STATE_INIT after a
+// line of a response that can't be parsed, as the connection is out of
+// step with the server, and returns the error for it.
+func (c *MapiConn) invalidResponse(line string) error {
+	c.State = MAPI_STATE_INIT
+	return fmt.Errorf("Invalid response: %s", line)
+}
+
+// readError moves the connection back to MAPI_STATE_INIT when reading
+// the response failed, as the rest of the response is lost.
+func (c *MapiConn) readError(err error) error {
+	if err == io.EOF {
+		return err
+	}
+	c.State = MAPI_STATE_INIT
+	return connectionLost(err)
 }
 
 // putBlock sends the given data as one or more blocks
@@ -0,0 +1,190 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func updateHandler(cmd string) string {
+	return "&2 1 -1\n"
+}
+
+// loginDatabase returns the database that a login response asks for.
+func loginDatabase(response string) string {
+	t := strings.Split(response, ":")
+	if len(t) < 5 {
+		return ""
+	}
+	return t[4]
+}
+
+// closedPort returns a port on which nothing is listening.
+func closedPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+func TestRedirectMerovingian(t *testing.T) {
+	var mu sync.Mutex
+	logins := 0
+	s := newFakeMerovingian(t, func(response string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		logins++
+		if logins < 3 {
+			return "#proxying\n^mapi:merovingian://proxy?database=demo\n"
+		}
+		return ""
+	}, updateHandler)
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if logins != 3 {
+		t.Errorf("Invalid number of logins: %d, expected: %d", logins, 3)
+	}
+	if c.mapi.State != MAPI_STATE_READY {
+		t.Errorf("Connection is not ready")
+	}
+}
+
+func TestRedirectServer(t *testing.T) {
+	var mu sync.Mutex
+	var database string
+	target := newFakeMerovingian(t, func(response string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		database = loginDatabase(response)
+		return ""
+	}, updateHandler)
+	defer target.Close()
+
+	tcs := []string{
+		fmt.Sprintf("^mapi:monetdb://127.0.0.1:%d/other\n", target.port()),
+		fmt.Sprintf("^mapi:monetdb://127.0.0.1:%d/other\n^mapi:monetdb://127.0.0.1:%d/third\n", target.port(), closedPort(t)),
+		fmt.Sprintf("^mapi:monetdb://127.0.0.1:%d/third\n^mapi:monetdb://127.0.0.1:%d/other\n", closedPort(t), target.port()),
+		"^mapi:merovingian://proxy?database=demo\n",
+	}
+
+	for i, redirect := range tcs {
+		redirects := []string{redirect}
+		if i == len(tcs)-1 {
+			// the proxy redirects to the server after another login
+			redirects = append(redirects, fmt.Sprintf("^mapi:monetdb://127.0.0.1:%d/other\n", target.port()))
+		}
+
+		s := newFakeMerovingian(t, func(response string) string {
+			mu.Lock()
+			defer mu.Unlock()
+			r := redirects[0]
+			redirects = redirects[1:]
+			return r
+		}, updateHandler)
+
+		mu.Lock()
+		database = ""
+		mu.Unlock()
+
+		c, err := openTestConn(t, s.dsn())
+		s.Close()
+		if err != nil {
+			t.Errorf("Error connecting: %s -> %v", redirect, err)
+			continue
+		}
+
+		mu.Lock()
+		if c.mapi.Port != target.port() || c.mapi.Database != "other" || database != "other" {
+			t.Errorf("Invalid redirect: %s -> %d %s %s", redirect, c.mapi.Port, c.mapi.Database, database)
+		}
+		mu.Unlock()
+		if _, err := c.ExecContext(context.Background(), "UPDATE t SET a = 1", nil); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		c.Close()
+	}
+}
+
+func TestRedirectUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	target := newFakeUnixServer(t, dir, 50124, updateHandler)
+	defer target.Close()
+
+	s := newFakeMerovingian(t, func(response string) string {
+		return fmt.Sprintf("^mapi:monetdb://%s?database=other\n", SocketPath(dir, 50124))
+	}, updateHandler)
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	if c.mapi.Socket != SocketPath(dir, 50124) || c.mapi.Database != "other" {
+		t.Errorf("Invalid redirect: %s %s", c.mapi.Socket, c.mapi.Database)
+	}
+	if _, err := c.ExecContext(context.Background(), "UPDATE t SET a = 1", nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRedirectErrors(t *testing.T) {
+	var loopPort atomic.Int64
+	loop := newFakeMerovingian(t, func(response string) string {
+		return fmt.Sprintf("^mapi:monetdb://127.0.0.1:%d/demo\n", loopPort.Load())
+	}, updateHandler)
+	loopPort.Store(int64(loop.port()))
+	defer loop.Close()
+
+	failing := newFakeMerovingian(t, func(response string) string {
+		return "!InvalidCredentialsException:checkCredentials:invalid credentials for user 'monetdb'\n"
+	}, updateHandler)
+	defer failing.Close()
+
+	tcs := []struct {
+		redirect string
+		err      string
+	}{
+		{"^mapi:merovingian://proxy?database=demo\n", "Maximal number of redirects reached (10)"},
+		{fmt.Sprintf("^mapi:monetdb://127.0.0.1:%d/demo\n", loop.port()), "Maximal number of redirects reached (10)"},
+		{fmt.Sprintf("^mapi:monetdb://127.0.0.1:%d/demo\n", failing.port()), "invalid credentials for user 'monetdb'"},
+		{fmt.Sprintf("^mapi:monetdb://127.0.0.1:%d/demo\n", closedPort(t)), "connection refused"},
+		{"^mapi:ftp://127.0.0.1/demo\n", "Unknown redirect: mapi:ftp://127.0.0.1/demo"},
+		{"^monetdb://127.0.0.1/demo\n", "Unknown redirect: monetdb://127.0.0.1/demo"},
+		{"^mapi:monetdb://127.0.0.1:port/demo\n", "Invalid redirect: mapi:monetdb://127.0.0.1:port/demo"},
+		{"^mapi:monetdb://\n", "Invalid redirect: mapi:monetdb://"},
+	}
+
+	for _, tc := range tcs {
+		redirect := tc.redirect
+		s := newFakeMerovingian(t, func(response string) string {
+			return redirect
+		}, updateHandler)
+
+		_, err := openTestConn(t, s.dsn())
+		s.Close()
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Invalid error for %s: %v, expected: %s", strings.TrimSpace(tc.redirect), err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// NestedTx is a transaction in which other transactions can be nested.
+// The outermost one is a transaction on the connection, the nested ones
+// are savepoints in it.
+//
+//	outer, err := monetdb.BeginNested(ctx, conn, nil)
+//	inner, err := outer.Begin()
+//	_, err = inner.Tx().ExecContext(ctx, "INSERT INTO t VALUES (1)")
+//	inner.Rollback() // only undoes the insert
+//	outer.Commit()
+//
+// Committing a nested transaction keeps its changes until the outer
+// transaction ends. Ending a transaction ends the ones nested in it.
+type NestedTx struct {
+	conn   *sql.Conn
+	tx     *sql.Tx
+	parent *NestedTx
+
+	// savepoint is the name of the savepoint of a nested transaction.
+	savepoint string
+	done      bool
+
+	// savepoints numbers the savepoints of the outermost transaction,
+	// so that the names of nested transactions are unique.
+	savepoints int
+}
+
+// BeginNested starts a transaction on the connection, in which other
+// transactions can be nested with Begin.
+func BeginNested(ctx context.Context, conn *sql.Conn, opts *sql.TxOptions) (*NestedTx, error) {
+	tx, err := conn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &NestedTx{conn: conn, tx: tx}, nil
+}
+
+// Tx returns the transaction in which the statements of this transaction,
+// and of the ones nested in it, are run.
+func (t *NestedTx) Tx() *sql.Tx {
+	return t.tx
+}
+
+// Begin starts a transaction that is nested in this one.
+func (t *NestedTx) Begin() (*NestedTx, error) {
+	if t.isDone() {
+		return nil, sql.ErrTxDone
+	}
+
+	root := t
+	for root.parent != nil {
+		root = root.parent
+	}
+	root.savepoints++
+
+	n := &NestedTx{
+		conn:      t.conn,
+		tx:        t.tx,
+		parent:    t,
+		savepoint: fmt.Sprintf("nested_tx_%d", root.savepoints),
+	}
+
+	err := n.raw(func(tx *Tx) error {
+		return tx.Savepoint(n.savepoint)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Commit commits the transaction. For a nested transaction, its changes
+// become part of the transaction it is nested in.
+func (t *NestedTx) Commit() error {
+	if t.isDone() {
+		return sql.ErrTxDone
+	}
+	t.done = true
+
+	if t.parent == nil {
+		return t.tx.Commit()
+	}
+	return t.raw(func(tx *Tx) error {
+		return tx.Release(t.savepoint)
+	})
+}
+
+// Rollback rolls the transaction back. For a nested transaction, only its
+// own changes are undone.
+func (t *NestedTx) Rollback() error {
+	if t.isDone() {
+		return sql.ErrTxDone
+	}
+	t.done = true
+
+	if t.parent == nil {
+		return t.tx.Rollback()
+	}
+	return t.raw(func(tx *Tx) error {
+		if err := tx.RollbackTo(t.savepoint); err != nil {
+			return err
+		}
+		return tx.Release(t.savepoint)
+	})
+}
+
+// isDone reports whether the transaction, or one that it is nested in,
+// has ended.
+func (t *NestedTx) isDone() bool {
+	for n := t; n != nil; n = n.parent {
+		if n.done {
+			return true
+		}
+	}
+	return false
+}
+
+// raw calls f with the Tx of the driver.
+func (t *NestedTx) raw(f func(tx *Tx) error) error {
+	return t.conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*Conn)
+		if !ok {
+			return fmt.Errorf("Not a MonetDB connection")
+		}
+		if c.Tx() == nil {
+			return fmt.Errorf("No transaction is open on the connection")
+		}
+		return f(c.Tx())
+	})
+}
@@ -0,0 +1,191 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A recording holds the traffic of a connection to a real server, so the
+// driver can be tested against the exact bytes that the server sends.
+// Recordings are kept as JSON in testdata, where the responses are
+// encoded in base64.
+type recording struct {
+	// Challenge is the challenge of the login, which holds the byte
+	// order and the options of the server.
+	Challenge string
+	Exchanges []exchange
+}
+
+// exchange is a command of the driver and the response of the server.
+type exchange struct {
+	Command  string
+	Response []byte
+}
+
+// recorder is a proxy to a server, which records the first connection
+// that is made through it.
+type recorder struct {
+	listener net.Listener
+	rec      recording
+	err      error
+	done     chan struct{}
+}
+
+// startRecorder starts a recorder for the server at address.
+func startRecorder(t *testing.T, address string) *recorder {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting recorder: %v", err)
+	}
+	r := &recorder{listener: l, done: make(chan struct{})}
+	go r.run(address)
+	return r
+}
+
+func (r *recorder) port() int {
+	return r.listener.Addr().(*net.TCPAddr).Port
+}
+
+// wait returns the recording once the connection has been closed.
+func (r *recorder) wait() (*recording, error) {
+	r.listener.Close()
+	<-r.done
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &r.rec, nil
+}
+
+func (r *recorder) run(address string) {
+	defer close(r.done)
+
+	c, err := r.listener.Accept()
+	if err != nil {
+		r.err = err
+		return
+	}
+	defer c.Close()
+
+	sc, err := net.Dial("tcp", address)
+	if err != nil {
+		r.err = err
+		return
+	}
+	defer sc.Close()
+
+	client := &MapiConn{conn: c}
+	server := &MapiConn{conn: sc}
+	forward := func(from, to *MapiConn) ([]byte, error) {
+		b, err := from.getBlock()
+		if err != nil {
+			return nil, err
+		}
+		return b, to.putBlock(b)
+	}
+
+	// the login, which is restarted after a redirect to a merovingian
+	// proxy
+	for {
+		challenge, err := forward(server, client)
+		if err != nil {
+			r.err = err
+			return
+		}
+		if _, err := forward(client, server); err != nil {
+			r.err = err
+			return
+		}
+		prompt, err := forward(server, client)
+		if err != nil {
+			r.err = err
+			return
+		}
+
+		if strings.Contains(string(prompt), "^mapi:merovingian:") {
+			continue
+		}
+		if strings.Contains(string(prompt), "^") || strings.Contains(string(prompt), "!") {
+			r.err = fmt.Errorf("Login failed: %s", prompt)
+			return
+		}
+		r.rec.Challenge = string(challenge)
+		break
+	}
+
+	for {
+		cmd, err := forward(client, server)
+		if err != nil {
+			// the driver closed the connection
+			return
+		}
+		resp, err := forward(server, client)
+		if err != nil {
+			r.err = err
+			return
+		}
+		r.rec.Exchanges = append(r.rec.Exchanges, exchange{Command: string(cmd), Response: resp})
+	}
+}
+
+func recordingPath(name string) string {
+	return filepath.Join("testdata", name+".json")
+}
+
+func saveRecording(t *testing.T, name string, rec *recording) {
+	b, err := json.MarshalIndent(rec, "", "\t")
+	if err != nil {
+		t.Fatalf("Error encoding recording: %v", err)
+	}
+	path := recordingPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Error saving recording: %v", err)
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		t.Fatalf("Error saving recording: %v", err)
+	}
+}
+
+// loadRecording returns the recording of the given name, or nil when it
+// hasn't been recorded.
+func loadRecording(t *testing.T, name string) *recording {
+	b, err := os.ReadFile(recordingPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Error loading recording: %v", err)
+	}
+	var rec recording
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatalf("Invalid recording %s: %v", name, err)
+	}
+	return &rec
+}
+
+// newReplayServer starts a fake server that answers the commands of a
+// recording in the order in which they were recorded.
+func newReplayServer(t *testing.T, rec *recording) *fakeServer {
+	var mu sync.Mutex
+	next := 0
+	return newFakeServerChallenge(t, rec.Challenge, func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if next >= len(rec.Exchanges) || rec.Exchanges[next].Command != cmd {
+			t.Errorf("Unexpected command: %q", cmd)
+			return "!42000!Unexpected command\n"
+		}
+		next++
+		return string(rec.Exchanges[next-1].Response)
+	})
+}
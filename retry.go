@@ -0,0 +1,105 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy controls how a transaction is retried after a conflict with
+// a concurrent transaction, see RunInTx.
+//
+// MonetDB uses optimistic concurrency control: a transaction that
+// conflicts with another one is aborted, usually at commit, and has to
+// be run again.
+type RetryPolicy struct {
+	// MaxAttempts is the number of times the transaction is run at
+	// most, including the first time.
+	MaxAttempts int
+
+	// Backoff is the time to wait before the first retry. It doubles
+	// for every next retry, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Jitter is the fraction of the backoff that is chosen at random,
+	// between 0 and 1, so that conflicting clients don't retry at the
+	// same time.
+	Jitter float64
+}
+
+// DefaultRetryPolicy is the RetryPolicy of RunInTx.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	Backoff:     10 * time.Millisecond,
+	MaxBackoff:  time.Second,
+	Jitter:      0.5,
+}
+
+// RunInTx runs fn in a transaction with DefaultRetryPolicy, see
+// RetryPolicy.RunInTx.
+func RunInTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(*sql.Tx) error) (int, error) {
+	return DefaultRetryPolicy.RunInTx(ctx, db, opts, fn)
+}
+
+// RunInTx runs fn in a transaction, which is committed when fn returns
+// nil and rolled back otherwise. When the transaction fails because of a
+// conflict with a concurrent transaction, which is an error that matches
+// ErrConflict, it is run again after a backoff.
+//
+// It returns the number of times the transaction was run, and the error
+// of the last attempt. As fn may run more than once, it should not have
+// effects outside of the transaction.
+func (p RetryPolicy) RunInTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(*sql.Tx) error) (int, error) {
+	attempts := 0
+	for {
+		attempts++
+		err := runTx(ctx, db, opts, fn)
+		if err == nil || !errors.Is(err, ErrConflict) || attempts >= p.MaxAttempts {
+			return attempts, err
+		}
+
+		t := time.NewTimer(p.backoff(attempts))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return attempts, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// backoff returns the time to wait after the given number of attempts.
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempts && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 && d > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+func runTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,183 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+const conflictError = "!40000!COMMIT: transaction is aborted because of concurrency conflicts, will ROLLBACK instead\n"
+
+// newConflictServer serves transactions of which the first conflicts
+// commits fail.
+func newConflictServer(t *testing.T, conflicts int, cmds *[]string) *fakeServer {
+	return newRecordingServer(t, cmds, func(cmd string) (string, bool) {
+		if cmd == "sCOMMIT;" && conflicts > 0 {
+			conflicts--
+			return conflictError, true
+		}
+		return "", false
+	})
+}
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     time.Millisecond,
+	MaxBackoff:  5 * time.Millisecond,
+	Jitter:      0.5,
+}
+
+func count(cmds []string, cmd string) int {
+	n := 0
+	for _, c := range cmds {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRunInTx(t *testing.T) {
+	tcs := []struct {
+		conflicts int
+		attempts  int
+		conflict  bool
+	}{
+		{0, 1, false},
+		{2, 3, false},
+		{5, 3, true},
+	}
+
+	for _, tc := range tcs {
+		var cmds []string
+		s := newConflictServer(t, tc.conflicts, &cmds)
+
+		db, err := sql.Open("monetdb", s.dsn())
+		if err != nil {
+			t.Fatalf("Error opening database: %v", err)
+		}
+
+		runs := 0
+		attempts, err := testRetryPolicy.RunInTx(context.Background(), db, nil, func(tx *sql.Tx) error {
+			runs++
+			_, err := tx.Exec("UPDATE t SET a = a + 1")
+			return err
+		})
+		db.Close()
+		s.Close()
+
+		if attempts != tc.attempts || runs != tc.attempts {
+			t.Errorf("Invalid number of attempts: %d, runs: %d, expected: %d", attempts, runs, tc.attempts)
+		}
+		if errors.Is(err, ErrConflict) != tc.conflict || (err != nil && !tc.conflict) {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if n := count(cmds, "sSTART TRANSACTION;"); n != tc.attempts {
+			t.Errorf("Invalid number of transactions: %d, expected: %d", n, tc.attempts)
+		}
+	}
+}
+
+func TestRunInTxConflictAfterInfo(t *testing.T) {
+	var cmds []string
+	commits := 0
+	s := newRecordingServer(t, &cmds, func(cmd string) (string, bool) {
+		if cmd == "sCOMMIT;" {
+			commits++
+			if commits <= 2 {
+				// the error is not the first line of the response
+				return "#warning\n" + conflictError, true
+			}
+		}
+		return "", false
+	})
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// the conflict is retried
+	attempts, err := testRetryPolicy.RunInTx(context.Background(), db, nil, func(tx *sql.Tx) error {
+		return nil
+	})
+	if attempts != 2 || err != nil {
+		t.Errorf("Unexpected result: %d %v", attempts, err)
+	}
+}
+
+func TestRunInTxError(t *testing.T) {
+	var cmds []string
+	s := newConflictServer(t, 5, &cmds)
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	// an error other than a conflict is not retried, and rolls back
+	failure := errors.New("failure")
+	attempts, err := testRetryPolicy.RunInTx(context.Background(), db, nil, func(tx *sql.Tx) error {
+		return failure
+	})
+	if attempts != 1 || err != failure {
+		t.Errorf("Unexpected result: %d %v", attempts, err)
+	}
+	if count(cmds, "sROLLBACK;") != 1 || count(cmds, "sCOMMIT;") != 0 {
+		t.Errorf("Invalid commands: %v", cmds)
+	}
+
+	// a conflict that is returned by fn is retried as well
+	attempts, err = testRetryPolicy.RunInTx(context.Background(), db, nil, func(tx *sql.Tx) error {
+		return &Error{Code: "40001", Message: "conflict"}
+	})
+	if attempts != 3 || !errors.Is(err, ErrConflict) {
+		t.Errorf("Unexpected result: %d %v", attempts, err)
+	}
+
+	// the backoff ends when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: time.Hour}
+	attempts, err = policy.RunInTx(ctx, db, nil, func(tx *sql.Tx) error {
+		cancel()
+		return &Error{Code: "40000", Message: "conflict"}
+	})
+	if attempts != 1 || err != context.Canceled {
+		t.Errorf("Unexpected result: %d %v", attempts, err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	expected := []time.Duration{10, 20, 40, 50, 50}
+	for i, e := range expected {
+		if d := p.backoff(i + 1); d != e*time.Millisecond {
+			t.Errorf("Invalid backoff after %d attempts: %v, expected: %v", i+1, d, e*time.Millisecond)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.backoff(2); d < 10*time.Millisecond || d > 20*time.Millisecond {
+			t.Errorf("Invalid backoff with jitter: %v", d)
+		}
+	}
+}
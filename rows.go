@@ -5,13 +5,28 @@
 package monetdb
 
 import (
+	"context"
 	"database/sql/driver"
 	"fmt"
 	"io"
+	"reflect"
 )
 
+// Rows reads a result set one tuple at a time, straight from the
+// connection.
+//
+// The server sends a result set in blocks of at most the reply size.
+// The next block is requested as soon as the current one starts, so the
+// server can send it while the current one is being read.
+//
+// When the connection is needed for another command before the current
+// block has been read, the rest of that block is read into memory.
+//
+// In the binary result set protocol, a block is always read into memory
+// at once, as its values are sent column by column.
 type Rows struct {
 	stmt   *Stmt
+	ctx    context.Context
 	active bool
 
 	queryId int
@@ -22,19 +37,42 @@ type Rows struct {
 	offset      int
 	lastRowId   int
 	rowCount    int
-	rows        [][]driver.Value
 	description []description
 	columns     []string
+
+	// fetchSize is the number of rows that is fetched at once.
+	fetchSize int
+
+	// blockEnd is the number of the first row after the current block.
+	blockEnd int
+
+	// streaming is set while the tuples of the current block are read
+	// from the connection, otherwise they are in buffered.
+	streaming bool
+	buffered  [][]driver.Value
+
+	// prefetched is set when the next block has been requested, and its
+	// response is waiting on the connection.
+	prefetched bool
+
+	// binary is set when the blocks after the first one are read in the
+	// binary format.
+	binary bool
+
+	// finish ends the cancellation watch of the response that is read.
+	finish func(error) error
 }
 
 func newRows(s *Stmt) *Rows {
 	return &Rows{
 		stmt:   s,
+		ctx:    context.Background(),
 		active: true,
 		err:    nil,
 
-		columns: nil,
-		rowNum:  0,
+		columns:   nil,
+		rowNum:    0,
+		fetchSize: defaultReplySize,
 	}
 }
 
@@ -48,48 +86,83 @@ func (r *Rows) Columns() []string {
 	return r.columns
 }
 
+// ColumnTypeScanType returns the Go type of the values of a column, which
+// is *big.Int for a hugeint.
+func (r *Rows) ColumnTypeScanType(index int) reflect.Type {
+	return scanType(r.description[index].columnType, r.stmt.conn.config.DecimalMode)
+}
+
 func (r *Rows) Close() error {
 	r.active = false
+	if r.stmt.conn.active == r {
+		return r.release(false)
+	}
 	return nil
 }
 
-var cnt = 0
-
 func (r *Rows) Next(dest []driver.Value) error {
 	if !r.active {
 		return fmt.Errorf("Rows closed")
 	}
-	if r.queryId == -1 {
-		return fmt.Errorf("Query didn't result in a resultset")
+	if r.err != nil {
+		return r.err
 	}
 
 	if r.rowNum >= r.rowCount {
 		return io.EOF
 	}
+	if r.queryId == -1 {
+		return fmt.Errorf("Query didn't result in a resultset")
+	}
 
-	if r.rowNum >= r.offset+len(r.rows) {
-		err := r.fetchNext()
-		if err != nil {
+	if r.rowNum >= r.blockEnd {
+		if err := r.fetchNext(); err != nil {
+			r.err = err
 			return err
 		}
 	}
 
-	for i, v := range r.rows[r.rowNum-r.offset] {
+	if r.streaming {
+		line, err := r.stmt.conn.mapi.readLine()
+		if err == io.EOF {
+			err = fmt.Errorf("Result set ended after %d of %d rows", r.rowNum, r.rowCount)
+		}
+		if err != nil {
+			r.err = r.end(err)
+			return r.err
+		}
+		err = r.stmt.parseTuple(line, dest)
+		if err != nil {
+			r.err = r.end(err)
+			return r.err
+		}
+	} else {
+		copy(dest, r.buffered[0])
+		r.buffered = r.buffered[1:]
+	}
+
+	for i, v := range dest {
 		if vv, ok := v.(string); ok {
 			dest[i] = []byte(vv)
-		} else {
-			dest[i] = v
 		}
 	}
 	r.rowNum += 1
 
+	if r.streaming && r.rowNum >= r.blockEnd {
+		r.streaming = false
+		if err := r.stmt.conn.mapi.drain(); err != nil {
+			r.err = r.end(err)
+			return r.err
+		}
+		if !r.prefetched {
+			r.err = r.end(nil)
+			return r.err
+		}
+	}
+
 	return nil
 }
 
-const (
-	c_ARRAY_SIZE = 100
-)
-
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -98,24 +171,169 @@ func min(a, b int) int {
 	}
 }
 
+// startBlock starts reading the tuples of a block, after the header of
+// the response has been read by the Stmt.
+func (r *Rows) startBlock(finish func(error) error) error {
+	conn := r.stmt.conn
+	r.offset = r.stmt.offset
+	r.blockEnd = r.offset + r.stmt.blockRows
+
+	if r.rowNum >= r.rowCount || r.stmt.blockRows == 0 {
+		return finish(conn.mapi.drain())
+	}
+
+	r.streaming = true
+	r.finish = finish
+	conn.active = r
+
+	if err := r.prefetch(); err != nil {
+		return r.end(err)
+	}
+	return nil
+}
+
+// prefetch requests the block after the current one.
+func (r *Rows) prefetch() error {
+	if r.prefetched || r.blockEnd >= r.rowCount {
+		return nil
+	}
+
+	amount := min(r.fetchSize, r.rowCount-r.blockEnd)
+	cmd := r.exportCommand(r.blockEnd, amount)
+	if err := r.stmt.conn.mapi.putBlock([]byte(cmd)); err != nil {
+		r.stmt.conn.mapi.State = MAPI_STATE_INIT
+		return connectionLost(err)
+	}
+
+	r.prefetched = true
+	return nil
+}
+
 func (r *Rows) fetchNext() error {
 	if r.rowNum >= r.rowCount {
 		return io.EOF
 	}
 
-	r.offset += len(r.rows)
-	end := min(r.rowCount, r.rowNum+c_ARRAY_SIZE)
-	amount := end - r.offset
+	conn := r.stmt.conn
+	if r.prefetched && conn.active == r {
+		// the response to the prefetched block is next on the connection
+		r.prefetched = false
+		conn.mapi.nextResponse()
+		if r.binary {
+			return r.readBinaryBlock(min(r.fetchSize, r.rowCount-r.rowNum))
+		}
+		if err := r.stmt.readResult(); err != nil {
+			return r.end(err)
+		}
+		return r.startBlock(r.finish)
+	}
 
-	cmd := fmt.Sprintf("Xexport %d %d %d", r.queryId, r.offset, amount)
-	res, err := r.stmt.conn.cmd(cmd)
+	r.prefetched = false
+	amount := min(r.fetchSize, r.rowCount-r.rowNum)
+	cmd := r.exportCommand(r.rowNum, amount)
+	if r.binary {
+		finish, err := conn.begin(r.ctx)
+		if err != nil {
+			return err
+		}
+		r.finish = finish
+		conn.active = r
+		if err := conn.mapi.send(cmd); err != nil {
+			return r.end(err)
+		}
+		return r.readBinaryBlock(amount)
+	}
+
+	finish, err := r.stmt.run(r.ctx, cmd)
 	if err != nil {
 		return err
 	}
+	return r.startBlock(finish)
+}
+
+// exportCommand returns the command that requests a block of rows.
+func (r *Rows) exportCommand(offset, amount int) string {
+	if r.binary {
+		return fmt.Sprintf("Xexportbin %d %d %d", r.queryId, offset, amount)
+	}
+	return fmt.Sprintf("Xexport %d %d %d", r.queryId, offset, amount)
+}
 
-	r.stmt.storeResult(res)
-	r.rows = r.stmt.rows
-	r.description = r.stmt.description
+// readBinaryBlock reads the response to a block in the binary format,
+// and requests the next block.
+func (r *Rows) readBinaryBlock(amount int) error {
+	m := r.stmt.conn.mapi
+	data, err := io.ReadAll(m.reader)
+	if err != nil {
+		return r.end(m.readError(err))
+	}
 
+	rows, err := decodeBinaryBlock(data, m.byteOrder, r.description, amount)
+	if err != nil {
+		return r.end(err)
+	}
+
+	if mode := r.stmt.conn.config.DecimalMode; mode != DecimalExact {
+		for _, row := range rows {
+			for i, v := range row {
+				if d, ok := v.(Decimal); ok {
+					row[i] = decimalValue(d, mode)
+				}
+			}
+		}
+	}
+
+	r.buffered = rows
+	r.offset = r.rowNum
+	r.blockEnd = r.rowNum + len(rows)
+
+	if err := r.prefetch(); err != nil {
+		return r.end(err)
+	}
+	if !r.prefetched {
+		return r.end(nil)
+	}
 	return nil
 }
+
+// end releases the connection after the result set has been read, or
+// failed with the given error.
+func (r *Rows) end(err error) error {
+	r.streaming = false
+	r.prefetched = false
+	r.stmt.conn.active = nil
+
+	finish := r.finish
+	r.finish = nil
+	if cerr := finish(err); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// release makes the connection available for another command. The rest
+// of the current block is kept in memory when keep is set, otherwise it
+// is discarded. A prefetched block is always discarded, it will be
+// requested again when needed.
+func (r *Rows) release(keep bool) error {
+	m := r.stmt.conn.mapi
+
+	var err error
+	if r.streaming && keep {
+		r.buffered, err = r.stmt.readTuples()
+	} else if r.streaming {
+		err = m.drain()
+	}
+	r.streaming = false
+
+	if err == nil && r.prefetched {
+		m.nextResponse()
+		err = m.drain()
+	}
+
+	err = r.end(err)
+	if err != nil {
+		r.err = err
+	}
+	return err
+}
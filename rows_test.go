@@ -0,0 +1,492 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// intBlock renders rows start..start+count-1 of a single int column.
+func intBlock(start, count int) string {
+	var b bytes.Buffer
+	for i := start; i < start+count; i++ {
+		fmt.Fprintf(&b, "[ %d\t]\n", i)
+	}
+	return b.String()
+}
+
+// newPagingServer serves a result set of the given number of rows, in
+// blocks of the reply size that the client asked for.
+func newPagingServer(t *testing.T, total int, cmds *[]string) *fakeServer {
+	return newFakeServer(t, pagingHandler(total, cmds))
+}
+
+// pagingHandler answers the commands that are sent to a paging server.
+func pagingHandler(total int, cmds *[]string) func(cmd string) string {
+	var mu sync.Mutex
+	replySize := 100
+	return func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		*cmds = append(*cmds, cmd)
+
+		var qid, offset, count int
+		switch {
+		case strings.HasPrefix(cmd, "Xreply_size "):
+			fmt.Sscanf(cmd, "Xreply_size %d", &replySize)
+			return ""
+		case strings.HasPrefix(cmd, "sPREPARE "):
+			return "&5 3 1 6 1\n"
+		case strings.HasPrefix(cmd, "sEXEC 3 "):
+			count = min(replySize, total)
+			return fmt.Sprintf("&1 4 %d 1 %d\n", total, count) +
+				"% sys.t # table_name\n% a # name\n% int # type\n% 3 # length\n" +
+				intBlock(0, count)
+		case strings.HasPrefix(cmd, "Xexport "):
+			fmt.Sscanf(cmd, "Xexport %d %d %d", &qid, &offset, &count)
+			return fmt.Sprintf("&6 %d 1 %d %d\n", qid, count, offset) + intBlock(offset, count)
+		case strings.HasPrefix(cmd, "Xexportbin "):
+			fmt.Sscanf(cmd, "Xexportbin %d %d %d", &qid, &offset, &count)
+			return intBinaryBlock(offset, count)
+		}
+		return "&2 0 -1\n"
+	}
+}
+
+func TestRowsPaging(t *testing.T) {
+	var cmds []string
+	s := newPagingServer(t, 250, &cmds)
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	tcs := []struct {
+		ctx     context.Context
+		exports []string
+	}{
+		{context.Background(), []string{"Xexport 4 100 100", "Xexport 4 200 50"}},
+		{WithReplySize(context.Background(), 120), []string{"Xreply_size 120", "Xexport 4 120 120", "Xexport 4 240 10"}},
+	}
+
+	for _, tc := range tcs {
+		cmds = nil
+		rows, err := db.QueryContext(tc.ctx, "SELECT a FROM t")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		n := 0
+		for rows.Next() {
+			var a int
+			if err := rows.Scan(&a); err != nil {
+				t.Fatalf("Error scanning row: %v", err)
+			}
+			if a != n {
+				t.Errorf("Invalid value: %d, expected: %d", a, n)
+			}
+			n++
+		}
+		if err := rows.Err(); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		rows.Close()
+
+		if n != 250 {
+			t.Errorf("Invalid number of rows: %d, expected: %d", n, 250)
+		}
+
+		var exports []string
+		for _, cmd := range cmds {
+			if strings.HasPrefix(cmd, "X") {
+				exports = append(exports, cmd)
+			}
+		}
+		if strings.Join(exports, ",") != strings.Join(tc.exports, ",") {
+			t.Errorf("Invalid commands: %v, expected: %v", exports, tc.exports)
+		}
+	}
+}
+
+func TestRowsCloseDuringPrefetch(t *testing.T) {
+	var cmds []string
+	s := newPagingServer(t, 250, &cmds)
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for i := 0; i < 3; i++ {
+		rows, err := db.Query("SELECT a FROM t")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		rows.Next()
+		rows.Close()
+	}
+
+	if _, err := db.Exec("UPDATE t SET a = 1"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRowsInterleavedCommand(t *testing.T) {
+	var cmds []string
+	s := newPagingServer(t, 250, &cmds)
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Error getting connection: %v", err)
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, "SELECT a FROM t")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var a int
+		if err := rows.Scan(&a); err != nil {
+			t.Fatalf("Error scanning row: %v", err)
+		}
+		if a != n {
+			t.Fatalf("Invalid value: %d, expected: %d", a, n)
+		}
+		n++
+
+		if n%70 == 0 {
+			// the connection is needed while the block is being read
+			if _, err := conn.ExecContext(ctx, "UPDATE t SET a = 1"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if n != 250 {
+		t.Errorf("Invalid number of rows: %d, expected: %d", n, 250)
+	}
+}
+
+func TestRowsLongLines(t *testing.T) {
+	long := strings.Repeat("x", 3*mapi_READ_BUFFER)
+	s := newFakeServer(t, func(cmd string) string {
+		if strings.HasPrefix(cmd, "sPREPARE ") {
+			return "&5 3 1 6 1\n"
+		}
+		if strings.HasPrefix(cmd, "sEXEC ") {
+			return "&1 4 3 1 3\n% sys.t # table_name\n% a # name\n% varchar # type\n% 0 # length\n" +
+				"[ \"short\"\t]\n[ \"" + long + "\"\t]\n[ \"end\"\t]\n"
+		}
+		return "&2 0 -1\n"
+	})
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT a FROM t")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var a string
+		if err := rows.Scan(&a); err != nil {
+			t.Fatalf("Error scanning row: %v", err)
+		}
+		values = append(values, a)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(values) != 3 || values[0] != "short" || values[1] != long || values[2] != "end" {
+		t.Errorf("Invalid values: %d rows", len(values))
+	}
+}
+
+func TestServerErrorKeepsConnection(t *testing.T) {
+	s := newFakeServer(t, func(cmd string) string {
+		if strings.Contains(cmd, "missing") {
+			return "!42S02!SELECT: no such table 'missing'\n"
+		}
+		return "&2 1 -1\n"
+	})
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.QueryContext(context.Background(), "SELECT * FROM missing", nil); err == nil {
+		t.Errorf("Expected an error for a missing table")
+	}
+	if _, err := c.ExecContext(context.Background(), "UPDATE t SET a = 1", nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	responses := []string{
+		"&1 1\n",
+		"&1 1 1 1 1\n% sys.t # table_name\n% a\n",
+		"&1 1 1 2 1\n% a # name\n",
+		"&1 1 1 1 1\n% a # name\n% decimal # type\n% 18 # typesizes\n[ 1\t]\n",
+		"&2 1\n",
+		"&6 1 1\n",
+	}
+
+	for _, response := range responses {
+		s := newFakeServer(t, func(cmd string) string {
+			if strings.HasPrefix(cmd, "sPREPARE ") {
+				return "&5 1 0 6 0\n"
+			}
+			if cmd == "sEXEC 1 ();" {
+				return response
+			}
+			return "&2 1 -1\n"
+		})
+
+		c, err := openTestConn(t, s.dsn())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		_, err = c.QueryContext(context.Background(), "SELECT a FROM t", nil)
+		if err == nil || !strings.HasPrefix(err.Error(), "Invalid response: ") {
+			t.Errorf("Unexpected error for %q: %v", response, err)
+		}
+
+		// the connection is out of step with the server
+		if c.IsValid() {
+			t.Errorf("Connection is still valid after %q", response)
+		}
+		if _, err := c.ExecContext(context.Background(), "UPDATE t SET a = 1", nil); err != driver.ErrBadConn {
+			t.Errorf("Unexpected error after %q: %v", response, err)
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestRowsHugeInt(t *testing.T) {
+	var mu sync.Mutex
+	var args string
+	s := newFakeServer(t, func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.HasPrefix(cmd, "sPREPARE "):
+			return "&5 1 1 6 1\n"
+		case strings.HasPrefix(cmd, "sEXEC 1 ("):
+			args = cmd
+			return "&1 2 2 1 2\n% sys.t # table_name\n% a # name\n% hugeint # type\n% 40 # length\n" +
+				"[ 170141183460469231731687303715884105727\t]\n" +
+				"[ -170141183460469231731687303715884105727\t]\n"
+		}
+		return "&2 0 -1\n"
+	})
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	min := new(big.Int).Sub(big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), 127))
+	rows, err := db.QueryContext(context.Background(), "SELECT a FROM t WHERE a >= ?", min)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if st := types[0].ScanType(); st != reflect.TypeOf((*big.Int)(nil)) {
+		t.Errorf("Invalid scan type: %v", st)
+	}
+
+	var values []string
+	for rows.Next() {
+		var v *big.Int
+		if err := rows.Scan(&v); err != nil {
+			t.Fatalf("Error scanning row: %v", err)
+		}
+		values = append(values, v.String())
+	}
+	if err := rows.Err(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	expected := []string{"170141183460469231731687303715884105727", "-170141183460469231731687303715884105727"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Invalid values: %v, expected: %v", values, expected)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if args != "sEXEC 1 (-170141183460469231731687303715884105727);" {
+		t.Errorf("Invalid arguments: %s", args)
+	}
+}
+
+func TestRowsNull(t *testing.T) {
+	var types []string
+	for columnType := range toGoMappers {
+		types = append(types, columnType)
+	}
+	sort.Strings(types)
+
+	names := make([]string, len(types))
+	nulls := make([]string, len(types))
+	for i, columnType := range types {
+		names[i] = columnType + "_col"
+		nulls[i] = "NULL"
+	}
+
+	// the queries are prepared, and each is executed with its own id
+	s := newFakeServer(t, func(cmd string) string {
+		switch cmd {
+		case "sPREPARE SELECT * FROM nulls;":
+			return "&5 1 1 6 1\n"
+		case "sPREPARE SELECT s FROM strings;":
+			return "&5 2 1 6 1\n"
+		case "sEXEC 1 ();":
+			return fmt.Sprintf("&1 1 1 %d 1\n%% sys.nulls # table_name\n%% %s # name\n%% %s # type\n[ %s\t]\n",
+				len(types), strings.Join(names, ",\t"), strings.Join(types, ",\t"), strings.Join(nulls, ",\t"))
+		case "sEXEC 2 ();":
+			return "&1 2 2 1 2\n% sys.strings # table_name\n% s # name\n% varchar # type\n" +
+				"[ NULL\t]\n[ \"NULL\"\t]\n"
+		}
+		return "&2 0 -1\n"
+	})
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT * FROM nulls")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !rows.Next() {
+		t.Fatalf("No rows: %v", rows.Err())
+	}
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// a pointer to a pointer of the scan type of each column
+	dest := make([]interface{}, len(types))
+	for i, ct := range columnTypes {
+		dest[i] = reflect.New(reflect.PointerTo(ct.ScanType())).Interface()
+	}
+	if err := rows.Scan(dest...); err != nil {
+		t.Fatalf("Error scanning row: %v", err)
+	}
+	for i, d := range dest {
+		if p := reflect.ValueOf(d).Elem(); !p.IsNil() {
+			t.Errorf("Invalid value for %s: %v, expected: nil", types[i], p.Elem())
+		}
+	}
+	rows.Close()
+
+	// the sql.Null types and our own types in sql.Null
+	row := db.QueryRow("SELECT * FROM nulls")
+	targets := map[string]interface{}{
+		"bigint":      &sql.NullInt64{Valid: true},
+		"int":         &sql.NullInt32{Valid: true},
+		"smallint":    &sql.NullInt16{Valid: true},
+		"tinyint":     &sql.NullByte{Valid: true},
+		"double":      &sql.NullFloat64{Valid: true},
+		"boolean":     &sql.NullBool{Valid: true},
+		"varchar":     &sql.NullString{Valid: true},
+		"clob":        &sql.NullString{Valid: true},
+		"timestamp":   &sql.NullTime{Valid: true},
+		"timestamptz": &sql.NullTime{Valid: true},
+		"date":        &sql.Null[Date]{Valid: true},
+		"time":        &sql.Null[Time]{Valid: true},
+		"decimal":     &sql.Null[Decimal]{Valid: true},
+		"hugeint":     &sql.Null[*big.Int]{Valid: true},
+	}
+	for i, columnType := range types {
+		if target, ok := targets[columnType]; ok {
+			dest[i] = target
+		} else {
+			dest[i] = new(interface{})
+		}
+	}
+	if err := row.Scan(dest...); err != nil {
+		t.Fatalf("Error scanning row: %v", err)
+	}
+	for columnType, target := range targets {
+		if valid := reflect.ValueOf(target).Elem().FieldByName("Valid").Bool(); valid {
+			t.Errorf("Invalid value for %s: %v, expected: NULL", columnType, target)
+		}
+	}
+
+	// a bare NULL and the string NULL
+	rows, err = db.Query("SELECT s FROM strings")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer rows.Close()
+
+	var values []sql.NullString
+	for rows.Next() {
+		var v sql.NullString
+		if err := rows.Scan(&v); err != nil {
+			t.Fatalf("Error scanning row: %v", err)
+		}
+		values = append(values, v)
+	}
+	expected := []sql.NullString{{}, {String: "NULL", Valid: true}}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Invalid values: %v, expected: %v", values, expected)
+	}
+}
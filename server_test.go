@@ -0,0 +1,234 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const fakeChallenge = "s4lt:mserver:9:SHA1,MD5:LIT:SHA512:"
+
+// fakeResponseBreak separates the responses in the return value of a
+// handler that sends more than one, as the server does after a file
+// download.
+const fakeResponseBreak = "\x00--response--\x00"
+
+// fakeServer is a minimal MAPI server, used to test the driver without
+// a running MonetDB.
+//
+// Each command that is received after the login is passed to handle,
+// and its return value is sent back as the response, or as more than
+// one separated by fakeResponseBreak.
+type fakeServer struct {
+	t         *testing.T
+	listener  net.Listener
+	challenge string
+	handle    func(cmd string) string
+
+	// login returns the prompt for a login response, when it is set.
+	// After a redirect to a merovingian proxy the login is restarted,
+	// after any other redirect or error the connection is closed.
+	login func(response string) string
+
+	mu    sync.Mutex
+	conns []net.Conn
+	wg    sync.WaitGroup
+}
+
+func newFakeServer(t *testing.T, handle func(cmd string) string) *fakeServer {
+	return newFakeServerChallenge(t, fakeChallenge, handle)
+}
+
+// newFakeServerChallenge starts a fake server that sends the given
+// challenge, to test the options that are announced in it.
+func newFakeServerChallenge(t *testing.T, challenge string, handle func(cmd string) string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting fake server: %v", err)
+	}
+	return startFakeServer(t, l, challenge, handle)
+}
+
+// newFakeUnixServer starts a fake server on a Unix domain socket in dir.
+func newFakeUnixServer(t *testing.T, dir string, port int, handle func(cmd string) string) *fakeServer {
+	l, err := net.Listen("unix", SocketPath(dir, port))
+	if err != nil {
+		t.Fatalf("Error starting fake server: %v", err)
+	}
+	return startFakeServer(t, l, fakeChallenge, handle)
+}
+
+// newFakeTLSServer starts a fake server that only accepts TLS connections.
+func newFakeTLSServer(t *testing.T, config *tls.Config, handle func(cmd string) string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting fake server: %v", err)
+	}
+	return startFakeServer(t, tls.NewListener(l, config), fakeChallenge, handle)
+}
+
+// newFakeMerovingian starts a fake server that answers the logins with
+// the prompts that login returns.
+func newFakeMerovingian(t *testing.T, login func(response string) string, handle func(cmd string) string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting fake server: %v", err)
+	}
+	s := &fakeServer{
+		t:         t,
+		listener:  l,
+		challenge: fakeChallenge,
+		handle:    handle,
+		login:     login,
+	}
+	return s.start()
+}
+
+func startFakeServer(t *testing.T, l net.Listener, challenge string, handle func(cmd string) string) *fakeServer {
+	s := &fakeServer{
+		t:         t,
+		listener:  l,
+		challenge: challenge,
+		handle:    handle,
+	}
+	return s.start()
+}
+
+func (s *fakeServer) start() *fakeServer {
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeServer) dsn() string {
+	return fmt.Sprintf("monetdb:monetdb@127.0.0.1:%d/demo", s.port())
+}
+
+func (s *fakeServer) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *fakeServer) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, c)
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.session(c)
+		}()
+	}
+}
+
+func (s *fakeServer) session(c net.Conn) {
+	defer c.Close()
+	m := &MapiConn{conn: c}
+
+	if c.LocalAddr().Network() == "unix" {
+		b := make([]byte, 1)
+		if _, err := c.Read(b); err != nil || b[0] != '0' {
+			s.t.Errorf("Invalid initial byte on Unix socket: %v", b)
+			return
+		}
+	}
+
+	for {
+		if err := m.putBlock([]byte(s.challenge)); err != nil {
+			return
+		}
+		response, err := m.getBlock()
+		if err != nil {
+			return
+		}
+
+		prompt := ""
+		if s.login != nil {
+			prompt = s.login(string(response))
+		}
+		if err := m.putBlock([]byte(prompt)); err != nil {
+			return
+		}
+
+		if strings.Contains(prompt, "^mapi:merovingian:") {
+			continue
+		}
+		if strings.Contains(prompt, "^") || strings.Contains(prompt, "!") {
+			return
+		}
+		break
+	}
+
+	for {
+		cmd, err := m.getBlock()
+		if err != nil {
+			return
+		}
+		for _, r := range strings.Split(s.handle(string(cmd)), fakeResponseBreak) {
+			if err := m.putBlock([]byte(r)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// newRecordingServer starts a fake server that records the commands that
+// it receives in cmds, and answers them with recordingResponse.
+//
+// override, when it is not nil, is called first for each command, and
+// its response is sent instead when it returns true. It is called with
+// the lock of the server held, so it can keep state of its own.
+func newRecordingServer(t *testing.T, cmds *[]string, override func(cmd string) (string, bool)) *fakeServer {
+	var mu sync.Mutex
+	return newFakeServer(t, func(cmd string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		*cmds = append(*cmds, cmd)
+
+		if override != nil {
+			if r, ok := override(cmd); ok {
+				return r
+			}
+		}
+		return recordingResponse(cmd)
+	})
+}
+
+// recordingResponse answers a command like a server in autocommit mode,
+// where every statement that isn't a transaction statement changes one
+// row.
+func recordingResponse(cmd string) string {
+	switch {
+	case strings.HasPrefix(cmd, "sPREPARE "):
+		return "&5 3 0 6 0\n"
+	case strings.HasPrefix(cmd, "sSTART TRANSACTION"):
+		return "&4 f\n"
+	case cmd == "sCOMMIT;" || cmd == "sROLLBACK;":
+		return "&4 t\n"
+	}
+	return "&2 1 -1\n"
+}
@@ -0,0 +1,167 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// session holds the settings of a session that a statement can change,
+// as they were after the session was set up.
+type session struct {
+	schema   string
+	role     string
+	timeZone string
+}
+
+// sessionChanges are the words that follow SET in a statement that
+// changes the settings of the session.
+var sessionChanges = map[string]bool{
+	"SCHEMA":         true,
+	"CURRENT_SCHEMA": true,
+	"ROLE":           true,
+	"TIME":           true,
+	"LOCAL":          true,
+	"SESSION":        true,
+}
+
+// changesSession reports whether a query may change the settings of the
+// session. An UPDATE of a column with one of those names is a false
+// positive, which only costs a round trip when the session is reset.
+func changesSession(q string) bool {
+	words := strings.FieldsFunc(strings.ToUpper(q), func(r rune) bool {
+		return unicode.IsSpace(r) || r == ';'
+	})
+	for i := 0; i+1 < len(words); i++ {
+		if words[i] == "SET" && sessionChanges[words[i+1]] {
+			return true
+		}
+	}
+	return false
+}
+
+// saveSession records the settings of the session, so they can be
+// restored when the connection is reused. A server that doesn't know
+// one of them leaves the session as it is.
+func (c *Conn) saveSession(ctx context.Context) {
+	rows, err := c.queryRows(ctx, "SELECT current_schema, current_role, CAST(current_timezone AS INT)")
+	if err != nil || len(rows) != 1 || len(rows[0]) != 3 {
+		c.logf("Session settings are unknown, they are not restored: %v", err)
+		return
+	}
+
+	c.defaults.schema, _ = rows[0][0].(string)
+	c.defaults.role, _ = rows[0][1].(string)
+	if v, ok := rows[0][2].(int32); ok {
+		c.defaults.timeZone = formatTimeZone(int(v))
+	}
+}
+
+// restoreSession restores the settings of the session after a statement
+// may have changed them.
+func (c *Conn) restoreSession(ctx context.Context) error {
+	var q []string
+	if c.defaults.schema != "" {
+		q = append(q, fmt.Sprintf("SET SCHEMA %s", quoteIdentifier(c.defaults.schema)))
+	}
+	if c.defaults.role != "" {
+		q = append(q, fmt.Sprintf("SET ROLE %s", quoteIdentifier(c.defaults.role)))
+	}
+	if c.defaults.timeZone != "" {
+		q = append(q, fmt.Sprintf("SET TIME ZONE INTERVAL '%s' HOUR TO MINUTE", c.defaults.timeZone))
+	}
+
+	if len(q) > 0 {
+		if _, err := c.executeContext(ctx, strings.Join(q, "; ")); err != nil {
+			return err
+		}
+	}
+	c.sessionChanged = false
+	return nil
+}
+
+// formatTimeZone turns the offset of current_timezone, in seconds, into
+// +HH:MM.
+func formatTimeZone(seconds int) string {
+	sign := '+'
+	minutes := seconds / 60
+	if minutes < 0 {
+		sign = '-'
+		minutes = -minutes
+	}
+	return fmt.Sprintf("%c%02d:%02d", sign, minutes/60, minutes%60)
+}
+
+// ResetSession is called by database/sql before a connection from the pool
+// is used again. A transaction that is still open, for example one that
+// was started with a START TRANSACTION statement, or the one that is
+// always open without autocommit, is rolled back, so the next user
+// doesn't take over the statements of the previous one. The autocommit
+// mode of the Config is restored. So are the schema, role and
+// time zone, after a statement may have changed them. Temporary tables
+// are kept until the connection is closed.
+//
+// The connection is rejected with driver.ErrBadConn when that fails, so
+// database/sql uses another one.
+func (c *Conn) ResetSession(ctx context.Context) error {
+	if !c.IsValid() {
+		return driver.ErrBadConn
+	}
+
+	autoCommit := !c.config.NoAutoCommit
+	if c.tx != nil || !c.autoCommit {
+		if c.tx != nil {
+			c.tx.end()
+		}
+		if _, err := c.executeContext(ctx, "ROLLBACK"); err != nil {
+			c.logf("Rolling back the open transaction failed: %v", err)
+			return driver.ErrBadConn
+		}
+		c.autoCommit = autoCommit
+	}
+
+	if c.autoCommit != autoCommit {
+		if err := c.setAutoCommit(ctx, autoCommit); err != nil {
+			return driver.ErrBadConn
+		}
+	}
+
+	if c.sessionChanged {
+		if err := c.restoreSession(ctx); err != nil {
+			c.logf("Restoring the session settings failed: %v", err)
+			return driver.ErrBadConn
+		}
+	}
+	return nil
+}
+
+// IsValid reports whether the connection can be used. It is not after an
+// I/O error or a response that could not be read, as the connection is
+// out of step with the server then.
+func (c *Conn) IsValid() bool {
+	return c.mapi != nil && c.mapi.State == MAPI_STATE_READY
+}
+
+// Ping checks that the server still answers, with a round trip that
+// doesn't touch any table. A connection that doesn't is rejected with
+// driver.ErrBadConn.
+func (c *Conn) Ping(ctx context.Context) error {
+	if !c.IsValid() {
+		return driver.ErrBadConn
+	}
+
+	if _, err := c.executeContext(ctx, "SELECT 1"); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.logf("Ping failed: %v", err)
+		return driver.ErrBadConn
+	}
+	return nil
+}
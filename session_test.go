@@ -0,0 +1,161 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+func TestChangesSession(t *testing.T) {
+	tcs := []struct {
+		query   string
+		changes bool
+	}{
+		{"SET SCHEMA other", true},
+		{"set current_schema = 'other'", true},
+		{"SET ROLE admin", true},
+		{"SET TIME ZONE INTERVAL '+02:00' HOUR TO MINUTE", true},
+		{"SET LOCAL TIME ZONE", true},
+		{"SET SESSION AUTHORIZATION other", true},
+		{"INSERT INTO t VALUES (1);SET\tschema other", true},
+		{"SELECT * FROM t", false},
+		{"UPDATE t SET a = 1", false},
+		{"SET", false},
+	}
+
+	for _, tc := range tcs {
+		if changes := changesSession(tc.query); changes != tc.changes {
+			t.Errorf("Invalid result for %s: %v, expected: %v", tc.query, changes, tc.changes)
+		}
+	}
+}
+
+func TestFormatTimeZone(t *testing.T) {
+	tcs := map[int]string{
+		0:      "+00:00",
+		3600:   "+01:00",
+		19800:  "+05:30",
+		-12600: "-03:30",
+	}
+
+	for seconds, expected := range tcs {
+		if tz := formatTimeZone(seconds); tz != expected {
+			t.Errorf("Invalid time zone for %d: %s, expected: %s", seconds, tz, expected)
+		}
+	}
+}
+
+// newSessionServer answers the query for the session settings and
+// records all commands.
+func newSessionServer(t *testing.T, cmds *[]string) *fakeServer {
+	return newRecordingServer(t, cmds, func(cmd string) (string, bool) {
+		if strings.Contains(cmd, "current_timezone") {
+			return "&1 0 1 3 1\n% .%1,\t.%2,\t.%3 # table_name\n" +
+				"% %1,\t%2,\t%3 # name\n% varchar,\tvarchar,\tint # type\n" +
+				"% 3,\t7,\t5 # length\n[ \"sys\",\t\"monetdb\",\t3600\t]\n", true
+		}
+		return "", false
+	})
+}
+
+func TestResetSessionRestoresSettings(t *testing.T) {
+	var cmds []string
+	s := newSessionServer(t, &cmds)
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec("UPDATE t SET a = 1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := db.Exec("UPDATE t SET a = 1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	restore := `sSET SCHEMA "sys"; SET ROLE "monetdb"; SET TIME ZONE INTERVAL '+01:00' HOUR TO MINUTE;`
+	if count(cmds, restore) != 0 {
+		t.Errorf("Settings were restored without a change: %v", cmds)
+	}
+
+	if _, err := db.Exec("SET SCHEMA other"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := db.Exec("UPDATE t SET a = 1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := db.Exec("UPDATE t SET a = 1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if count(cmds, restore) != 1 {
+		t.Errorf("Settings were not restored once: %v", cmds)
+	}
+}
+
+func TestPing(t *testing.T) {
+	s := newFakeServer(t, func(cmd string) string {
+		switch {
+		case cmd == "sSELECT 1;":
+			return "&1 0 1 1 1\n% .%1 # table_name\n% %1 # name\n% tinyint # type\n% 1 # length\n[ 1\t]\n"
+		case strings.Contains(cmd, "UPDATE"):
+			return "?unknown\n"
+		}
+		return "&2 1 -1\n"
+	})
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Ping(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !c.IsValid() {
+		t.Errorf("Connection is not valid")
+	}
+
+	// a response that can't be read leaves the connection out of step
+	if _, err := c.ExecContext(context.Background(), "UPDATE t SET a = 1", nil); err == nil {
+		t.Errorf("Expected an error for an unknown response")
+	}
+	if c.IsValid() {
+		t.Errorf("Connection is valid after an unknown response")
+	}
+	if err := c.Ping(context.Background()); err != driver.ErrBadConn {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := c.ResetSession(context.Background()); err != driver.ErrBadConn {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestPingLostConnection(t *testing.T) {
+	s := newFakeServer(t, updateHandler)
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.Ping(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s.Close()
+	if err := db.Ping(); err == nil {
+		t.Errorf("Expected an error after the server was closed")
+	}
+}
@@ -6,8 +6,10 @@ package monetdb
 
 import (
 	"bytes"
+	"context"
 	"database/sql/driver"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -24,7 +26,10 @@ type Stmt struct {
 	offset      int
 	columnCount int
 
-	rows        [][]driver.Value
+	// blockRows is the number of tuples that follow the header of
+	// the response.
+	blockRows int
+
 	description []description
 }
 
@@ -57,47 +62,75 @@ func (s *Stmt) NumInput() int {
 }
 
 func (s *Stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *Stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
 	res := newResult()
 
-	r, err := s.exec(args)
+	finish, err := s.exec(ctx, args)
+	if err == nil {
+		// a result set is of no use here
+		err = finish(s.conn.mapi.drain())
+	}
 	if err != nil {
 		res.err = err
 		return res, res.err
 	}
 
-	err = s.storeResult(r)
 	res.lastInsertId = s.lastRowId
 	res.rowsAffected = s.rowCount
-	res.err = err
 
 	return res, res.err
 }
 
 func (s *Stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *Stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
 	rows := newRows(s)
+	rows.ctx = ctx
 
-	r, err := s.exec(args)
+	replySize := replySizeFromContext(ctx, s.conn.config.ReplySize)
+	if err := s.conn.setReplySize(ctx, replySize); err != nil {
+		rows.err = err
+		return rows, rows.err
+	}
+	rows.fetchSize = replySize
+
+	finish, err := s.exec(ctx, args)
 	if err != nil {
 		rows.err = err
 		return rows, rows.err
 	}
 
-	err = s.storeResult(r)
 	rows.queryId = s.queryId
 	rows.lastRowId = s.lastRowId
 	rows.rowCount = s.rowCount
 	rows.offset = s.offset
-	rows.rows = s.rows
 	rows.description = s.description
+	rows.binary = s.conn.binaryResults() && binaryDecodable(s.description)
+	if s.queryId < 0 {
+		// not a query, there are no rows to read
+		rows.rowCount = 0
+	}
 
+	rows.err = rows.startBlock(finish)
 	return rows, rows.err
 }
 
-func (s *Stmt) exec(args []driver.Value) (string, error) {
+// exec executes the statement with the given arguments and reads the
+// header of the response. The tuples of the result set are left in the
+// response.
+//
+// The returned function must be called once the rest of the response
+// has been read, see Conn.watchCancel.
+func (s *Stmt) exec(ctx context.Context, args []driver.NamedValue) (func(error) error, error) {
 	if s.execId == -1 {
-		err := s.prepareQuery()
+		err := s.prepareQuery(ctx)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
@@ -105,9 +138,12 @@ func (s *Stmt) exec(args []driver.Value) (string, error) {
 	b.WriteString(fmt.Sprintf("EXEC %d (", s.execId))
 
 	for i, v := range args {
-		str, err := convertToMonet(v)
+		if v.Name != "" {
+			return nil, fmt.Errorf("Named parameters are not supported")
+		}
+		str, err := convertToMonet(v.Value)
 		if err != nil {
-			return "", nil
+			return nil, err
 		}
 		if i > 0 {
 			b.WriteString(", ")
@@ -116,20 +152,48 @@ func (s *Stmt) exec(args []driver.Value) (string, error) {
 	}
 
 	b.WriteString(")")
-	return s.conn.execute(b.String())
+	return s.run(ctx, fmt.Sprintf("s%s;", b.String()))
 }
 
-func (s *Stmt) prepareQuery() error {
-	q := fmt.Sprintf("PREPARE %s", s.query)
-	r, err := s.conn.execute(q)
+func (s *Stmt) prepareQuery(ctx context.Context) error {
+	q := fmt.Sprintf("sPREPARE %s;", s.query)
+	finish, err := s.run(ctx, q)
 	if err != nil {
 		return err
 	}
+	return finish(s.conn.mapi.drain())
+}
+
+// run sends a command and reads the header of its response, see exec.
+func (s *Stmt) run(ctx context.Context, cmd string) (func(error) error, error) {
+	finish, err := s.conn.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if changesSession(s.query) {
+		s.conn.sessionChanged = true
+	}
+
+	err = s.conn.mapi.send(cmd)
+	if err == nil {
+		err = s.readResult()
+	}
+	if err != nil {
+		if cerr := finish(err); cerr != nil {
+			return nil, cerr
+		}
+		return nil, err
+	}
 
-	return s.storeResult(r)
+	return finish, nil
 }
 
-func (s *Stmt) storeResult(r string) error {
+// readResult reads the header of a response, up to the first tuple or the
+// end of the response.
+//
+// An error that is reported by the server is returned once the rest of
+// the response has been read, so the connection can still be used.
+func (s *Stmt) readResult() error {
 	var columnNames []string
 	var columnTypes []string
 	var displaySizes []int
@@ -138,20 +202,61 @@ func (s *Stmt) storeResult(r string) error {
 	var scales []int
 	var nullOks []int
 
-	for _, line := range strings.Split(r, "\n") {
+	m := s.conn.mapi
+	s.queryId = -1
+	s.blockRows = 0
+
+	// header lines only describe a result set after &1, the ones that
+	// follow &5 describe the parameters of a prepared statement
+	header := false
+
+	var serverErr error
+	var dbErr *Error
+	for {
+		b, err := m.peek()
+		if err == io.EOF {
+			return serverErr
+		}
+		if err != nil {
+			return err
+		}
+		if b == mapi_MSG_TUPLE[0] && serverErr == nil {
+			return nil
+		}
+
+		l, err := m.readLine()
+		if err != nil {
+			return err
+		}
+		line := string(l)
+
 		if strings.HasPrefix(line, mapi_MSG_INFO) {
-			// TODO log
+			s.conn.logf("%s", line[1:])
+
+		} else if line+"\n" == mapi_MSG_MORE {
+			// tell server it isn't going to get more
+			if err := m.send(""); err != nil {
+				return err
+			}
 
 		} else if strings.HasPrefix(line, mapi_MSG_QPREPARE) {
 			t := strings.Split(strings.TrimSpace(line[2:]), " ")
 			s.execId, _ = strconv.Atoi(t[0])
-			return nil
+			header = false
 
 		} else if strings.HasPrefix(line, mapi_MSG_QTABLE) {
-			t := strings.Split(strings.TrimSpace(line[2:]), " ")
+			t, err := responseFields(m, line, 3)
+			if err != nil {
+				return err
+			}
 			s.queryId, _ = strconv.Atoi(t[0])
 			s.rowCount, _ = strconv.Atoi(t[1])
 			s.columnCount, _ = strconv.Atoi(t[2])
+			if len(t) > 3 {
+				s.blockRows, _ = strconv.Atoi(t[3])
+			} else {
+				s.blockRows = s.rowCount
+			}
 
 			columnNames = make([]string, s.columnCount)
 			columnTypes = make([]string, s.columnCount)
@@ -160,38 +265,47 @@ func (s *Stmt) storeResult(r string) error {
 			precisions = make([]int, s.columnCount)
 			scales = make([]int, s.columnCount)
 			nullOks = make([]int, s.columnCount)
+			header = true
 
-		} else if strings.HasPrefix(line, mapi_MSG_TUPLE) {
-			v, err := s.parseTuple(line)
+		} else if strings.HasPrefix(line, mapi_MSG_QBLOCK) {
+			t, err := responseFields(m, line, 4)
 			if err != nil {
 				return err
 			}
-			s.rows = append(s.rows, v)
-
-		} else if strings.HasPrefix(line, mapi_MSG_QBLOCK) {
-			s.rows = make([][]driver.Value, 0)
+			s.queryId, _ = strconv.Atoi(t[0])
+			s.blockRows, _ = strconv.Atoi(t[2])
+			s.offset, _ = strconv.Atoi(t[3])
 
 		} else if strings.HasPrefix(line, mapi_MSG_QSCHEMA) {
 			s.offset = 0
-			s.rows = make([][]driver.Value, 0)
 			s.lastRowId = 0
 			s.description = nil
 			s.rowCount = 0
 
 		} else if strings.HasPrefix(line, mapi_MSG_QUPDATE) {
-			t := strings.Split(strings.TrimSpace(line[2:]), " ")
+			t, err := responseFields(m, line, 2)
+			if err != nil {
+				return err
+			}
 			s.rowCount, _ = strconv.Atoi(t[0])
 			s.lastRowId, _ = strconv.Atoi(t[1])
 
 		} else if strings.HasPrefix(line, mapi_MSG_QTRANS) {
+			s.conn.trackTransaction(line)
 			s.offset = 0
-			s.rows = make([][]driver.Value, 0, 0)
 			s.lastRowId = 0
 			s.description = nil
 			s.rowCount = 0
 
 		} else if strings.HasPrefix(line, mapi_MSG_HEADER) {
+			if !header {
+				continue
+			}
+
 			t := strings.Split(line[1:], "#")
+			if len(t) < 2 {
+				return m.invalidResponse(line)
+			}
 			data := strings.TrimSpace(t[0])
 			identity := strings.TrimSpace(t[1])
 
@@ -200,6 +314,12 @@ func (s *Stmt) storeResult(r string) error {
 				values = append(values, strings.TrimSpace(value))
 			}
 
+			// the lines that are used have a value for each column
+			used := identity == "name" || identity == "type" || identity == "typesizes"
+			if used && len(values) != s.columnCount {
+				return m.invalidResponse(line)
+			}
+
 			if identity == "name" {
 				columnNames = values
 
@@ -215,10 +335,13 @@ func (s *Stmt) storeResult(r string) error {
 						s = append(s, val)
 					}
 					internalSizes[i] = s[0]
-					sizes = append(sizes, s)
+					sizes[i] = s
 				}
 				for j, t := range columnTypes {
 					if t == "decimal" {
+						if len(sizes[j]) < 2 {
+							return m.invalidResponse(line)
+						}
 						precisions[j] = sizes[j][0]
 						scales[j] = sizes[j][1]
 					}
@@ -230,33 +353,82 @@ func (s *Stmt) storeResult(r string) error {
 			s.offset = 0
 			s.lastRowId = 0
 
-		} else if strings.HasPrefix(line, mapi_MSG_PROMPT) {
-			return nil
-
 		} else if strings.HasPrefix(line, mapi_MSG_ERROR) {
-			return fmt.Errorf("Database error: %s", line[1:])
+			dbErr = dbErr.add(line[1:])
+			if serverErr == nil {
+				serverErr = dbErr
+			}
+
+		} else if strings.HasPrefix(line, mapi_MSG_OK) || line == mapi_MSG_PROMPT {
+			// pass
 
+		} else if m.transferRequested() {
+			if err := m.fileTransfer(line); err != nil {
+				if m.State != MAPI_STATE_READY {
+					return err
+				}
+				if serverErr == nil {
+					serverErr = err
+				}
+			}
+
+		} else if serverErr == nil && !strings.HasPrefix(line, mapi_MSG_TUPLE) {
+			// the connection is out of step with the server
+			m.State = MAPI_STATE_INIT
+			serverErr = fmt.Errorf("Unknown state: %s", line)
 		}
 	}
+}
 
-	return fmt.Errorf("Unknown state: %s", r)
+// readTuples reads the remaining tuples of the response.
+func (s *Stmt) readTuples() ([][]driver.Value, error) {
+	rows := make([][]driver.Value, 0)
+	for {
+		line, err := s.conn.mapi.readLine()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		v := make([]driver.Value, len(s.description))
+		if err := s.parseTuple(line, v); err != nil {
+			s.conn.mapi.drain()
+			return nil, err
+		}
+		rows = append(rows, v)
+	}
 }
 
-func (s *Stmt) parseTuple(d string) ([]driver.Value, error) {
-	items := strings.Split(d[1:len(d)-1], ",\t")
+// parseTuple decodes a tuple line into dest.
+func (s *Stmt) parseTuple(line []byte, dest []driver.Value) error {
+	items, err := splitTuple(string(line))
+	if err != nil {
+		return err
+	}
 	if len(items) != len(s.description) {
-		return nil, fmt.Errorf("Length of row doesn't match header")
+		return fmt.Errorf("Length of row doesn't match header")
 	}
 
-	v := make([]driver.Value, len(items))
 	for i, value := range items {
-		vv, err := s.convert(value, s.description[i].columnType)
+		vv, err := s.convert(value, s.description[i])
 		if err != nil {
-			return nil, err
+			return err
 		}
-		v[i] = vv
+		dest[i] = vv
+	}
+	return nil
+}
+
+// responseFields returns the fields of a line of a response such as
+// "&1 id rows columns ...", of which there must be at least n.
+func responseFields(m *MapiConn, line string, n int) ([]string, error) {
+	t := strings.Split(strings.TrimSpace(line[2:]), " ")
+	if len(t) < n {
+		return nil, m.invalidResponse(line)
 	}
-	return v, nil
+	return t, nil
 }
 
 func (s *Stmt) updateDescription(
@@ -280,7 +452,21 @@ func (s *Stmt) updateDescription(
 	s.description = d
 }
 
-func (s *Stmt) convert(value, dataType string) (driver.Value, error) {
-	val, err := convertToGo(value, dataType)
+func (s *Stmt) convert(value string, d description) (driver.Value, error) {
+	if d.columnType == mdb_DECIMAL {
+		if isNull(value) {
+			return nil, nil
+		}
+		return toDecimal(strings.TrimSpace(value), s.conn.config.DecimalMode)
+	}
+	val, err := convertToGo(value, d.columnType)
 	return val, err
 }
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	nv := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		nv[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return nv
+}
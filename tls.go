@@ -0,0 +1,105 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// mapiALPN is the protocol name announced during the TLS handshake.
+const mapiALPN = "mapi/9"
+
+var (
+	tlsConfigLock     sync.RWMutex
+	tlsConfigRegistry = map[string]*tls.Config{}
+)
+
+// RegisterTLSConfig registers a custom tls.Config under the given name.
+// The configuration is used for connections whose DSN contains the
+// tls=<name> option.
+//
+// Use it to provide a CA bundle (RootCAs), client certificates
+// (Certificates) or a different server name (ServerName).
+//
+// The names "true", "false" and "skip-verify" are reserved.
+func RegisterTLSConfig(name string, config *tls.Config) error {
+	switch strings.ToLower(name) {
+	case "true", "false", "skip-verify":
+		return fmt.Errorf("Reserved TLS config name: %s", name)
+	}
+
+	tlsConfigLock.Lock()
+	tlsConfigRegistry[name] = config
+	tlsConfigLock.Unlock()
+	return nil
+}
+
+// DeregisterTLSConfig removes the tls.Config registered under the given name.
+func DeregisterTLSConfig(name string) {
+	tlsConfigLock.Lock()
+	delete(tlsConfigRegistry, name)
+	tlsConfigLock.Unlock()
+}
+
+func getTLSConfig(name string) (*tls.Config, bool) {
+	tlsConfigLock.RLock()
+	c, ok := tlsConfigRegistry[name]
+	tlsConfigLock.RUnlock()
+	return c, ok
+}
+
+// parseTLSConfig returns the tls.Config that belongs to the value of the
+// tls option of a DSN. It returns nil when TLS is disabled.
+func parseTLSConfig(value string) (*tls.Config, error) {
+	switch strings.ToLower(value) {
+	case "true", "1":
+		return &tls.Config{}, nil
+	case "false", "0", "":
+		return nil, nil
+	case "skip-verify":
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+
+	c, ok := getTLSConfig(value)
+	if !ok {
+		return nil, fmt.Errorf("Unknown TLS config: %s", value)
+	}
+	return c.Clone(), nil
+}
+
+// pinCertificate makes the tls.Config accept only a server certificate
+// whose SHA-256 fingerprint matches the given hash. The hash is written
+// as "sha256:" followed by hex digits, which may be separated by colons.
+//
+// The fingerprint replaces the verification of the certificate chain.
+func pinCertificate(c *tls.Config, certhash string) error {
+	t := strings.SplitN(certhash, ":", 2)
+	if len(t) != 2 || strings.ToLower(t[0]) != "sha256" {
+		return fmt.Errorf("Unsupported certificate hash: %s", certhash)
+	}
+	fingerprint, err := hex.DecodeString(strings.Replace(t[1], ":", "", -1))
+	if err != nil || len(fingerprint) != sha256.Size {
+		return fmt.Errorf("Invalid certificate hash: %s", certhash)
+	}
+
+	c.InsecureSkipVerify = true
+	c.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return fmt.Errorf("Server did not send a certificate")
+		}
+		h := sha256.Sum256(cs.PeerCertificates[0].Raw)
+		if !bytes.Equal(h[:], fingerprint) {
+			return fmt.Errorf("Server certificate does not match %s", certhash)
+		}
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mapi_MSG_FILETRANS is the prompt that follows a file transfer request
+// at the end of a response.
+var mapi_MSG_FILETRANS = string([]byte{1, 3, 10})
+
+// UploadHandler opens the files that the server reads with
+// COPY INTO ... FROM ... ON CLIENT.
+type UploadHandler interface {
+	// Upload opens the file with the given name, as it was written in
+	// the query. In binary mode the file holds the column data of
+	// COPY BINARY INTO, otherwise it is text.
+	//
+	// The returned reader is closed when the server has read enough,
+	// which may be before its end. An error is reported to the server,
+	// which fails the query with it.
+	Upload(filename string, binary bool) (io.ReadCloser, error)
+}
+
+// DownloadHandler creates the files that the server writes with
+// COPY ... INTO ... ON CLIENT.
+type DownloadHandler interface {
+	// Download creates the file with the given name, as it was written
+	// in the query. In binary mode the server sends column data,
+	// otherwise text.
+	//
+	// The returned writer is closed when the server has sent all data.
+	// An error is reported to the server, which fails the query with it.
+	Download(filename string, binary bool) (io.WriteCloser, error)
+}
+
+// DirectoryHandler is an UploadHandler and DownloadHandler for the files
+// in a directory. The names in queries are relative to that directory,
+// a name that refers to a file outside of it is refused.
+type DirectoryHandler struct {
+	root *os.Root
+}
+
+// NewDirectoryHandler returns a DirectoryHandler for the given directory.
+func NewDirectoryHandler(dir string) (*DirectoryHandler, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectoryHandler{root: root}, nil
+}
+
+// Upload opens a file in the directory.
+func (h *DirectoryHandler) Upload(filename string, binary bool) (io.ReadCloser, error) {
+	return h.root.Open(filename)
+}
+
+// Download creates or truncates a file in the directory.
+func (h *DirectoryHandler) Download(filename string, binary bool) (io.WriteCloser, error) {
+	return h.root.Create(filename)
+}
+
+// Close releases the directory.
+func (h *DirectoryHandler) Close() error {
+	return h.root.Close()
+}
+
+// transferRequested reports whether the line that was just read is a
+// file transfer request, which is followed by its prompt.
+func (c *MapiConn) transferRequested() bool {
+	b, err := c.reader.Peek(len(mapi_MSG_FILETRANS))
+	return err == nil && string(b) == mapi_MSG_FILETRANS
+}
+
+// fileTransfer handles a file transfer request of the server, after
+// which the response to the query continues.
+//
+// An error of the handler is returned while the connection stays usable.
+// Otherwise the connection is moved back to MAPI_STATE_INIT, as it is
+// out of step with the server.
+func (c *MapiConn) fileTransfer(request string) error {
+	// the prompt ends the response, if it wasn't read already
+	if err := c.drain(); err != nil {
+		return err
+	}
+
+	var err error
+	switch t := strings.SplitN(request, " ", 3); {
+	case len(t) == 3 && t[0] == "r":
+		var offset int
+		offset, err = strconv.Atoi(t[1])
+		if err == nil {
+			err = c.upload(t[2], false, offset)
+		}
+	case len(t) >= 2 && t[0] == "rb":
+		err = c.upload(strings.Join(t[1:], " "), true, 0)
+	case len(t) >= 2 && t[0] == "w":
+		err = c.download(strings.Join(t[1:], " "), false)
+	case len(t) >= 2 && t[0] == "wb":
+		err = c.download(strings.Join(t[1:], " "), true)
+	default:
+		err = c.refuseTransfer(fmt.Errorf("Invalid file transfer request: %s", request))
+	}
+
+	if c.State == MAPI_STATE_READY {
+		c.nextResponse()
+	}
+	return err
+}
+
+// refuseTransfer tells the server that a file transfer failed, and
+// returns the error.
+func (c *MapiConn) refuseTransfer(err error) error {
+	msg := strings.ReplaceAll(err.Error(), "\n", " ")
+	if perr := c.putBlock([]byte(msg + "\n")); perr != nil {
+		c.State = MAPI_STATE_INIT
+		return connectionLost(perr)
+	}
+	return err
+}
+
+// upload sends a file to the server. The file is sent in blocks, after
+// each of which the server prompts for more, or cancels the upload with
+// the prompt of a file transfer when it has read enough. In text mode,
+// the data starts at the line of the OFFSET of the query.
+func (c *MapiConn) upload(filename string, binary bool, offset int) error {
+	if c.UploadHandler == nil {
+		return c.refuseTransfer(fmt.Errorf("No upload handler is configured"))
+	}
+	f, err := c.UploadHandler.Upload(filename, binary)
+	if err != nil {
+		return c.refuseTransfer(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if !binary && offset > 1 {
+		r = &lineSkipper{r: bufio.NewReader(f), n: offset - 1}
+	}
+
+	// an empty line accepts the request, the data follows
+	buf := make([]byte, copyBlockSize)
+	buf[0] = '\n'
+	start := 1
+	for {
+		n, err := io.ReadFull(r, buf[start:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			// there is no way to fail the upload, so the server must
+			// not get the impression that the file ended here
+			c.Disconnect()
+			return err
+		}
+		if n == 0 && start == 0 {
+			break
+		}
+
+		if perr := c.putBlock(buf[:start+n]); perr != nil {
+			c.State = MAPI_STATE_INIT
+			return connectionLost(perr)
+		}
+		start = 0
+
+		c.nextResponse()
+		resp, rerr := io.ReadAll(c.reader)
+		if rerr != nil {
+			return c.readError(rerr)
+		}
+		switch string(resp) {
+		case mapi_MSG_MORE:
+		case mapi_MSG_FILETRANS:
+			// the server cancelled the upload, the response follows
+			return nil
+		default:
+			c.State = MAPI_STATE_INIT
+			return fmt.Errorf("Invalid response to an upload: %q", resp)
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	// an empty block ends the upload
+	if err := c.putBlock(nil); err != nil {
+		c.State = MAPI_STATE_INIT
+		return connectionLost(err)
+	}
+	return nil
+}
+
+// download receives a file from the server, which is sent as a single
+// response. When the file can't be written, the rest of it is read and
+// discarded, and the error is returned.
+func (c *MapiConn) download(filename string, binary bool) error {
+	if c.DownloadHandler == nil {
+		return c.refuseTransfer(fmt.Errorf("No download handler is configured"))
+	}
+	f, err := c.DownloadHandler.Download(filename, binary)
+	if err != nil {
+		return c.refuseTransfer(err)
+	}
+
+	if err := c.putBlock([]byte("\n")); err != nil {
+		f.Close()
+		c.State = MAPI_STATE_INIT
+		return connectionLost(err)
+	}
+
+	c.nextResponse()
+	w := &transferWriter{w: f}
+	_, err = io.Copy(w, c.reader)
+	cerr := f.Close()
+	if err != nil {
+		return c.readError(err)
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return cerr
+}
+
+// lineSkipper leaves out the first n lines of a reader.
+type lineSkipper struct {
+	r *bufio.Reader
+	n int
+}
+
+func (s *lineSkipper) Read(p []byte) (int, error) {
+	for s.n > 0 {
+		_, err := s.r.ReadSlice('\n')
+		if err == nil {
+			s.n--
+		} else if err != bufio.ErrBufferFull {
+			return 0, err
+		}
+	}
+	return s.r.Read(p)
+}
+
+// transferWriter keeps the error of writing a downloaded file apart
+// from the errors of reading it from the connection.
+type transferWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *transferWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		// discard the rest of the file
+		return len(p), nil
+	}
+	if _, err := w.w.Write(p); err != nil {
+		w.err = err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,260 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// transferServer is a fake server that requests a file transfer for
+// every COPY statement.
+type transferServer struct {
+	mu sync.Mutex
+
+	// request is the file transfer request, such as "r 0 data.csv".
+	request string
+
+	// download is the file that is sent for a "w" request.
+	download string
+
+	// cancelAfter is the number of upload blocks after which the server
+	// cancels the upload, or zero to read all of it.
+	cancelAfter int
+
+	uploading   bool
+	downloading bool
+	blocks      int
+	upload      bytes.Buffer
+	refusal     string
+}
+
+func (s *transferServer) handle(cmd string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.uploading:
+		if s.blocks == 0 && !strings.HasPrefix(cmd, "\n") {
+			s.uploading = false
+			s.refusal = cmd
+			return "!HY000!COPY INTO: " + cmd
+		}
+		// an empty block ends the upload
+		if cmd == "" {
+			s.uploading = false
+			return "&2 1 -1\n"
+		}
+		if s.blocks == 0 {
+			cmd = cmd[1:]
+		}
+		s.blocks++
+		s.upload.WriteString(cmd)
+
+		// the server prompts for more, or cancels the upload with the
+		// prompt of a file transfer, after which the response follows
+		if s.blocks == s.cancelAfter {
+			s.uploading = false
+			return mapi_MSG_FILETRANS + fakeResponseBreak + "&2 1 -1\n"
+		}
+		return mapi_MSG_MORE
+
+	case s.downloading:
+		s.downloading = false
+		if cmd != "\n" {
+			s.refusal = cmd
+			return "!HY000!COPY INTO: " + cmd
+		}
+		return s.download + fakeResponseBreak + "&2 2 -1\n"
+
+	case cmd == "":
+		// the end of an upload that was cancelled
+		return "!HY000!Unexpected empty block\n"
+
+	case strings.HasPrefix(cmd, "sPREPARE "):
+		return "&5 1 0 6 0\n"
+
+	case cmd == "sEXEC 1 ();" || strings.HasPrefix(cmd, "sCOPY "):
+		s.uploading = s.request[0] != 'w'
+		s.downloading = s.request[0] == 'w'
+		s.blocks = 0
+		s.upload.Reset()
+		return "#copying\n" + s.request + "\n" + mapi_MSG_FILETRANS
+	}
+	return "&2 1 -1\n"
+}
+
+func (s *transferServer) result() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.upload.String(), s.refusal
+}
+
+func newTransferConn(t *testing.T, ts *transferServer, dir string) (*Conn, func()) {
+	s := newFakeServer(t, ts.handle)
+
+	c := NewConfig()
+	c.Hostname = "127.0.0.1"
+	c.Port = s.port()
+	c.Database = "demo"
+	if dir != "" {
+		h, err := NewDirectoryHandler(dir)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		c.UploadHandler = h
+		c.DownloadHandler = h
+	}
+
+	conn, err := newConn(context.Background(), c)
+	if err != nil {
+		s.Close()
+		t.Fatalf("Error connecting: %v", err)
+	}
+	return conn, func() {
+		conn.Close()
+		s.Close()
+	}
+}
+
+func TestUpload(t *testing.T) {
+	dir := t.TempDir()
+	data := "1,one\n2,two\n3,three\n"
+	if err := os.WriteFile(filepath.Join(dir, "data.csv"), []byte(data), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	large := strings.Repeat("0123456789", copyBlockSize/3)
+	if err := os.WriteFile(filepath.Join(dir, "large.bin"), []byte(large), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tcs := []struct {
+		request     string
+		cancelAfter int
+		expected    string
+	}{
+		{"r 0 data.csv", 0, data},
+		{"r 1 data.csv", 0, data},
+		{"r 3 data.csv", 0, "3,three\n"},
+		{"r 5 data.csv", 0, ""},
+		{"rb large.bin", 0, large},
+		{"rb large.bin", 1, large[:copyBlockSize-1]},
+		{"rb large.bin", 2, large[:2*copyBlockSize-1]},
+	}
+
+	for _, tc := range tcs {
+		ts := &transferServer{request: tc.request, cancelAfter: tc.cancelAfter}
+		c, done := newTransferConn(t, ts, dir)
+
+		// both through a prepared statement and a plain command
+		if _, err := c.ExecContext(context.Background(), "COPY INTO t FROM 'f' ON CLIENT", nil); err != nil {
+			t.Errorf("Unexpected error for %s: %v", tc.request, err)
+		}
+		if upload, _ := ts.result(); upload != tc.expected {
+			t.Errorf("Invalid upload for %s: %d bytes, expected: %d", tc.request, len(upload), len(tc.expected))
+		}
+
+		if _, err := c.executeContext(context.Background(), "COPY INTO t FROM 'f' ON CLIENT"); err != nil {
+			t.Errorf("Unexpected error for %s: %v", tc.request, err)
+		}
+		if upload, _ := ts.result(); upload != tc.expected {
+			t.Errorf("Invalid upload for %s: %d bytes, expected: %d", tc.request, len(upload), len(tc.expected))
+		}
+		done()
+	}
+}
+
+func TestDownload(t *testing.T) {
+	dir := t.TempDir()
+	ts := &transferServer{request: "w out.csv", download: "1,one\n2,two\n"}
+	c, done := newTransferConn(t, ts, dir)
+	defer done()
+
+	res, err := c.ExecContext(context.Background(), "COPY SELECT * FROM t INTO 'out.csv' ON CLIENT", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Errorf("Invalid number of rows: %d", n)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "out.csv"))
+	if err != nil || string(b) != ts.download {
+		t.Errorf("Invalid download: %q %v", b, err)
+	}
+
+	// the connection is still in step with the server
+	if _, err := c.executeContext(context.Background(), "UPDATE t SET a = 1"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestTransferRefused(t *testing.T) {
+	dir := t.TempDir()
+
+	tcs := []struct {
+		request string
+		dir     string
+		err     string
+	}{
+		{"r 0 data.csv", "", "No upload handler is configured"},
+		{"w out.csv", "", "No download handler is configured"},
+		{"r 0 missing.csv", dir, "no such file"},
+		{"r 0 ../data.csv", dir, "path escapes"},
+		{"rb /etc/passwd", dir, "path escapes"},
+		{"w ../out.csv", dir, "path escapes"},
+		{"x data.csv", dir, "Invalid file transfer request: x data.csv"},
+	}
+
+	for _, tc := range tcs {
+		ts := &transferServer{request: tc.request}
+		c, done := newTransferConn(t, ts, tc.dir)
+
+		_, err := c.ExecContext(context.Background(), "COPY INTO t FROM 'f' ON CLIENT", nil)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Invalid error for %s: %v, expected: %s", tc.request, err, tc.err)
+		}
+		if _, refusal := ts.result(); !strings.Contains(refusal, tc.err) {
+			t.Errorf("Invalid refusal for %s: %q", tc.request, refusal)
+		}
+
+		if _, err := c.executeContext(context.Background(), "UPDATE t SET a = 1"); err != nil {
+			t.Errorf("Unexpected error after %s: %v", tc.request, err)
+		}
+		done()
+	}
+}
+
+func TestLineSkipper(t *testing.T) {
+	// the first line is longer than the buffer
+	long := strings.Repeat("a", 40)
+	tcs := []struct {
+		n        int
+		expected string
+	}{
+		{0, long + "\nb\nc"},
+		{1, "b\nc"},
+		{2, "c"},
+		{3, ""},
+	}
+
+	for _, tc := range tcs {
+		r := bufio.NewReaderSize(strings.NewReader(long+"\nb\nc"), 16)
+		b, err := io.ReadAll(&lineSkipper{r: r, n: tc.n})
+		if err != nil && err != io.EOF {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if string(b) != tc.expected {
+			t.Errorf("Invalid data after skipping %d lines: %q, expected: %q", tc.n, b, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A tuple of a result set in the text format is sent as a line
+//
+//	[ value,\tvalue,\t...\t]
+//
+// Strings are quoted with double quotes, in which a double quote,
+// backslash, tab, newline or other control character is escaped with a
+// backslash. NULL is a bare NULL, so it can't be mistaken for the string
+// "NULL". Values of other types are never quoted, and don't contain the
+// separator.
+
+// splitTuple returns the values of a tuple line as they were sent, with
+// the quotes of strings, which the converters of toGoMappers remove.
+func splitTuple(line string) ([]string, error) {
+	s := strings.TrimRight(line, " \t\r\n")
+	if !strings.HasPrefix(s, mapi_MSG_TUPLE) || !strings.HasSuffix(s, "]") || len(s) < 2 {
+		return nil, fmt.Errorf("Invalid tuple: %s", line)
+	}
+	s = s[1 : len(s)-1]
+
+	// a tuple has at least one value, and one after each comma, which
+	// is empty for an empty blob
+	var values []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+
+		var value string
+		if s != "" && s[0] == '"' {
+			end := quotedEnd(s)
+			if end < 0 {
+				return nil, fmt.Errorf("Invalid tuple, unterminated string: %s", line)
+			}
+			value, s = s[:end], strings.TrimLeft(s[end:], " \t")
+			if s != "" && s[0] != ',' {
+				return nil, fmt.Errorf("Invalid tuple, text after string: %s", line)
+			}
+		} else {
+			end := strings.Index(s, ",\t")
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimRight(s[:end], " \t"), s[end:]
+		}
+
+		values = append(values, value)
+		if s == "" {
+			return values, nil
+		}
+		// the comma
+		s = s[1:]
+	}
+}
+
+// quotedEnd returns the end of the quoted string at the start of s, after
+// its closing quote, or -1 when it isn't closed.
+func quotedEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// unquote replaces the escapes of a string without its quotes. Besides
+// the usual single character escapes, there are octal escapes of a byte,
+// \ooo, and hexadecimal escapes of a byte, \xhh, or of a unicode code
+// point, \uhhhh and \Uhhhhhhhh.
+func unquote(s string) (string, error) {
+	// Is it trivial?  Avoid allocation.
+	i := strings.IndexByte(s, '\\')
+	if i < 0 {
+		return s, nil
+	}
+
+	buf := make([]byte, 0, len(s))
+	buf = append(buf, s[:i]...)
+	for s = s[i:]; s != ""; {
+		if s[0] != '\\' {
+			i := strings.IndexByte(s, '\\')
+			if i < 0 {
+				i = len(s)
+			}
+			buf, s = append(buf, s[:i]...), s[i:]
+			continue
+		}
+
+		if len(s) < 2 {
+			return "", fmt.Errorf("Invalid escape at the end of %q", s)
+		}
+		c := s[1]
+		s = s[2:]
+
+		switch c {
+		case 'n':
+			buf = append(buf, '\n')
+		case 't':
+			buf = append(buf, '\t')
+		case 'r':
+			buf = append(buf, '\r')
+		case 'f':
+			buf = append(buf, '\f')
+		case 'b':
+			buf = append(buf, '\b')
+		case 'a':
+			buf = append(buf, '\a')
+		case 'v':
+			buf = append(buf, '\v')
+		case '\\', '"', '\'':
+			buf = append(buf, c)
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			// up to three octal digits
+			n := 1
+			for n < 3 && n <= len(s) && s[n-1] >= '0' && s[n-1] <= '7' {
+				n++
+			}
+			v, err := strconv.ParseUint(string(c)+s[:n-1], 8, 8)
+			if err != nil {
+				return "", fmt.Errorf("Invalid octal escape: \\%c%s", c, s[:n-1])
+			}
+			buf, s = append(buf, byte(v)), s[n-1:]
+		case 'x', 'u', 'U':
+			n := 2
+			if c == 'u' {
+				n = 4
+			} else if c == 'U' {
+				n = 8
+			}
+			if len(s) < n {
+				return "", fmt.Errorf("Invalid escape: \\%c%s", c, s)
+			}
+			v, err := strconv.ParseUint(s[:n], 16, 32)
+			if err != nil || c != 'x' && !utf8.ValidRune(rune(v)) {
+				return "", fmt.Errorf("Invalid escape: \\%c%s", c, s[:n])
+			}
+			if c == 'x' {
+				buf = append(buf, byte(v))
+			} else {
+				buf = utf8.AppendRune(buf, rune(v))
+			}
+			s = s[n:]
+		default:
+			return "", fmt.Errorf("Invalid escape: \\%c", c)
+		}
+	}
+	return string(buf), nil
+}
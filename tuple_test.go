@@ -0,0 +1,206 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSplitTuple(t *testing.T) {
+	tcs := []struct {
+		line     string
+		expected []string
+	}{
+		{"[ 1,\t2\t]", []string{"1", "2"}},
+		{"[ 1\t]", []string{"1"}},
+		{"[ 1\t]  \r", []string{"1"}},
+		{"[ ]", []string{""}},
+		{"[ \t]", []string{""}},
+		{"[ 1,\t\t]", []string{"1", ""}},
+		{"[ ,\t1\t]", []string{"", "1"}},
+		{"[ \"a,\tb\",\t\"c\"\t]", []string{"\"a,\tb\"", "\"c\""}},
+		{"[ \"say \\\"hi\\\",\t\",\t1\t]", []string{"\"say \\\"hi\\\",\t\"", "1"}},
+		{"[ \"back\\\\\",\tNULL\t]", []string{"\"back\\\\\"", "NULL"}},
+		{"[ \"NULL\",\tNULL\t]", []string{"\"NULL\"", "NULL"}},
+		{"[ \"\",\t\"\"\t]", []string{"\"\"", "\"\""}},
+		{"[ 2001-01-02 10:20:30.000000+01:00,\t-1.50\t]", []string{"2001-01-02 10:20:30.000000+01:00", "-1.50"}},
+		{"[ \"a\"  ,\t\"b\"\t]", []string{"\"a\"", "\"b\""}},
+	}
+
+	for _, tc := range tcs {
+		values, err := splitTuple(tc.line)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tc.line, err)
+		} else if !reflect.DeepEqual(values, tc.expected) {
+			t.Errorf("Invalid values for %q: %q, expected: %q", tc.line, values, tc.expected)
+		}
+	}
+}
+
+func TestSplitTupleInvalid(t *testing.T) {
+	tcs := []struct {
+		line string
+		err  string
+	}{
+		{"", "Invalid tuple: "},
+		{"[", "Invalid tuple: ["},
+		{"1,\t2\t]", "Invalid tuple: 1,\t2\t]"},
+		{"[ 1,\t2", "Invalid tuple: [ 1,\t2"},
+		{"[ \"a\t]", "Invalid tuple, unterminated string: [ \"a\t]"},
+		{"[ \"a\\\"\t]", "Invalid tuple, unterminated string: [ \"a\\\"\t]"},
+		{"[ \"a\"b,\t1\t]", "Invalid tuple, text after string: [ \"a\"b,\t1\t]"},
+	}
+
+	for _, tc := range tcs {
+		_, err := splitTuple(tc.line)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("Invalid error for %q: %v, expected: %s", tc.line, err, tc.err)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tcs := []struct {
+		s        string
+		expected string
+	}{
+		{"plain", "plain"},
+		{"", ""},
+		{`tab\there`, "tab\there"},
+		{`line\nbreak\r`, "line\nbreak\r"},
+		{`back\\slash`, `back\slash`},
+		{`say \"hi\"`, `say "hi"`},
+		{`it\'s`, `it's`},
+		{`\101\102C`, "ABC"},
+		{`\0`, "\x00"},
+		{`\12x`, "\nx"},
+		{`\x41\x7e`, "A~"},
+		{`été`, "été"},
+		{`\U0001F600`, "\U0001F600"},
+		{`mixed ü \"\\ end`, `mixed ü "\ end`},
+	}
+
+	for _, tc := range tcs {
+		s, err := unquote(tc.s)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tc.s, err)
+		} else if s != tc.expected {
+			t.Errorf("Invalid value for %q: %q, expected: %q", tc.s, s, tc.expected)
+		}
+	}
+
+	for _, s := range []string{`end\`, `\q`, `\777`, `\x4`, `\xzz`, `\u12`, `\ud800`, `\U00110000`} {
+		if v, err := unquote(s); err == nil {
+			t.Errorf("Expected an error for %q, got: %q", s, v)
+		}
+	}
+}
+
+func TestParseTupleStrings(t *testing.T) {
+	s := &Stmt{
+		conn: &Conn{},
+		description: []description{
+			{columnName: "a", columnType: "varchar"},
+			{columnName: "b", columnType: "int"},
+			{columnName: "c", columnType: "clob"},
+		},
+	}
+
+	dest := make([]driver.Value, 3)
+	line := "[ \"one,\ttwo\",\t42,\t\"say \\\"hi\\\"\\n\\\\\"\t]"
+	if err := s.parseTuple([]byte(line), dest); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []driver.Value{"one,\ttwo", int32(42), "say \"hi\"\n\\"}
+	if !reflect.DeepEqual(dest, expected) {
+		t.Errorf("Invalid values: %q, expected: %q", dest, expected)
+	}
+
+	if err := s.parseTuple([]byte("[ \"a\",\t1\t]"), dest); err == nil {
+		t.Errorf("Expected an error for a short row")
+	}
+}
+
+// quoteTuple renders strings as a tuple line, the way the server does.
+func quoteTuple(values []string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\t", `\t`, "\n", `\n`)
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = `"` + escaper.Replace(v) + `"`
+	}
+	return "[ " + strings.Join(quoted, ",\t") + "\t]"
+}
+
+func FuzzSplitTuple(f *testing.F) {
+	f.Add("[ 1,\t2\t]")
+	f.Add("[ \"a,\tb\",\tNULL\t]")
+	f.Add("[ \"say \\\"hi\\\"\",\t\"\\101\\u00e9\"\t]")
+	f.Add("[ \"\\")
+	f.Add("[\"]")
+	f.Add("[ 2001-01-02,\t10:20:30,\t-1.5e10\t]")
+
+	var types []string
+	for columnType := range toGoMappers {
+		types = append(types, columnType)
+	}
+	sort.Strings(types)
+
+	f.Fuzz(func(t *testing.T, line string) {
+		values, err := splitTuple(line)
+		if err != nil {
+			return
+		}
+		for _, v := range values {
+			for _, columnType := range types {
+				convertToGo(v, columnType)
+			}
+			for _, mode := range []DecimalMode{DecimalExact, DecimalString, DecimalFloat64} {
+				toDecimal(v, mode)
+			}
+		}
+
+		// the strings of the tuple are sent back as they were
+		var decoded []string
+		for _, v := range values {
+			s, ok := quoted(v)
+			if !ok {
+				return
+			}
+			if s, err = unquote(s); err != nil {
+				return
+			}
+			decoded = append(decoded, s)
+		}
+		again, err := splitTuple(quoteTuple(decoded))
+		if err != nil {
+			t.Fatalf("Error splitting %q: %v", quoteTuple(decoded), err)
+		}
+		if len(again) != len(decoded) {
+			t.Fatalf("Invalid number of values for %q: %d, expected: %d", quoteTuple(decoded), len(again), len(decoded))
+		}
+		for i, v := range again {
+			if s, err := strip(v); err != nil || s != decoded[i] {
+				t.Errorf("Invalid value: %q, %v, expected: %q", s, err, decoded[i])
+			}
+		}
+	})
+}
+
+func FuzzUnquote(f *testing.F) {
+	f.Add(`plain`)
+	f.Add(`\t\n\\\"`)
+	f.Add(`\101\x41é\U0001F600`)
+	f.Add(`\`)
+	f.Add(`\7777`)
+
+	f.Fuzz(func(t *testing.T, s string) {
+		unquote(s)
+	})
+}
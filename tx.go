@@ -4,9 +4,60 @@
 
 package monetdb
 
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// isolationLevels maps the isolation levels of database/sql to the ones
+// of MonetDB. The server runs a transaction at the requested level or a
+// stronger one. Snapshot isolation is provided by SERIALIZABLE.
+var isolationLevels = map[sql.IsolationLevel]string{
+	sql.LevelReadUncommitted: "READ UNCOMMITTED",
+	sql.LevelReadCommitted:   "READ COMMITTED",
+	sql.LevelRepeatableRead:  "REPEATABLE READ",
+	sql.LevelSnapshot:        "SERIALIZABLE",
+	sql.LevelSerializable:    "SERIALIZABLE",
+}
+
+// startTransaction returns the statement that starts a transaction with
+// the given options.
+func startTransaction(opts driver.TxOptions) (string, error) {
+	var modes []string
+
+	level := sql.IsolationLevel(opts.Isolation)
+	if level != sql.LevelDefault {
+		name, ok := isolationLevels[level]
+		if !ok {
+			return "", fmt.Errorf("Isolation level is not supported: %s", level)
+		}
+		modes = append(modes, "ISOLATION LEVEL "+name)
+	}
+	if opts.ReadOnly {
+		modes = append(modes, "READ ONLY")
+	}
+
+	if len(modes) == 0 {
+		return "START TRANSACTION", nil
+	}
+	return "START TRANSACTION " + strings.Join(modes, ", "), nil
+}
+
+// Tx is a transaction on a Conn. Besides committing and rolling back,
+// it can set savepoints in the transaction. The Tx that is open on a
+// connection is returned by Conn.Tx, for use with sql.Conn.Raw.
 type Tx struct {
 	conn *Conn
 	err  error
+	done bool
+
+	// started is set when the transaction was started with START
+	// TRANSACTION, so the session returns to autocommit mode at its end.
+	started bool
 }
 
 func newTx(c *Conn) *Tx {
@@ -17,11 +68,88 @@ func newTx(c *Conn) *Tx {
 }
 
 func (t *Tx) Commit() error {
-	_, err := t.conn.execute("COMMIT")
-	return err
+	return t.finish("COMMIT")
 }
 
 func (t *Tx) Rollback() error {
-	_, err := t.conn.execute("ROLLBACK")
+	return t.finish("ROLLBACK")
+}
+
+// finish ends the transaction with the given statement.
+func (t *Tx) finish(q string) error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.end()
+
+	if t.conn.autoCommit {
+		// a statement in the transaction ended it already
+		return fmt.Errorf("No transaction in progress for %s, it was already ended", q)
+	}
+
+	// the transaction ends even when the statement fails
+	_, err := t.conn.execute(q)
+	if t.started {
+		t.conn.autoCommit = true
+	}
+	return err
+}
+
+func (t *Tx) end() {
+	t.done = true
+	if t.conn.tx == t {
+		t.conn.tx = nil
+	}
+}
+
+// Savepoint sets a savepoint with the given name, to which the
+// transaction can be rolled back with RollbackTo.
+func (t *Tx) Savepoint(name string) error {
+	return t.savepoint("SAVEPOINT %s", name)
+}
+
+// RollbackTo rolls the transaction back to the savepoint with the given
+// name. The savepoint is kept.
+func (t *Tx) RollbackTo(name string) error {
+	return t.savepoint("ROLLBACK TO SAVEPOINT %s", name)
+}
+
+// Release removes the savepoint with the given name, and the ones that
+// were set after it. The transaction is not affected.
+func (t *Tx) Release(name string) error {
+	return t.savepoint("RELEASE SAVEPOINT %s", name)
+}
+
+func (t *Tx) savepoint(format, name string) error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	if err := checkSavepointName(name); err != nil {
+		return err
+	}
+	_, err := t.conn.execute(fmt.Sprintf(format, quoteIdentifier(name)))
 	return err
 }
+
+// maxIdentifierLength is the maximum length of an identifier in MonetDB.
+const maxIdentifierLength = 1024
+
+// checkSavepointName checks that a savepoint name can be used as a
+// quoted identifier.
+func checkSavepointName(name string) error {
+	if name == "" {
+		return fmt.Errorf("Savepoint name is empty")
+	}
+	if len(name) > maxIdentifierLength {
+		return fmt.Errorf("Savepoint name is longer than %d bytes", maxIdentifierLength)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("Savepoint name is not valid UTF-8")
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("Savepoint name contains a control character: %q", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,497 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package monetdb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBeginTxOptions(t *testing.T) {
+	var cmds []string
+	s := newRecordingServer(t, &cmds, nil)
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	tcs := []struct {
+		opts     *sql.TxOptions
+		expected string
+	}{
+		{nil, "sSTART TRANSACTION;"},
+		{&sql.TxOptions{Isolation: sql.LevelReadUncommitted}, "sSTART TRANSACTION ISOLATION LEVEL READ UNCOMMITTED;"},
+		{&sql.TxOptions{Isolation: sql.LevelReadCommitted}, "sSTART TRANSACTION ISOLATION LEVEL READ COMMITTED;"},
+		{&sql.TxOptions{Isolation: sql.LevelRepeatableRead}, "sSTART TRANSACTION ISOLATION LEVEL REPEATABLE READ;"},
+		{&sql.TxOptions{Isolation: sql.LevelSnapshot}, "sSTART TRANSACTION ISOLATION LEVEL SERIALIZABLE;"},
+		{&sql.TxOptions{Isolation: sql.LevelSerializable}, "sSTART TRANSACTION ISOLATION LEVEL SERIALIZABLE;"},
+		{&sql.TxOptions{ReadOnly: true}, "sSTART TRANSACTION READ ONLY;"},
+		{&sql.TxOptions{Isolation: sql.LevelSerializable, ReadOnly: true}, "sSTART TRANSACTION ISOLATION LEVEL SERIALIZABLE, READ ONLY;"},
+	}
+
+	for _, tc := range tcs {
+		tx, err := db.BeginTx(context.Background(), tc.opts)
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %v", tc.opts, err)
+			continue
+		}
+		tx.Rollback()
+
+		// the START TRANSACTION before the ROLLBACK
+		if last := cmds[len(cmds)-2]; last != tc.expected {
+			t.Errorf("Invalid command for %v: %s, expected: %s", tc.opts, last, tc.expected)
+		}
+	}
+
+	for _, level := range []sql.IsolationLevel{sql.LevelWriteCommitted, sql.LevelLinearizable} {
+		_, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: level})
+		if err == nil || !strings.Contains(err.Error(), level.String()) {
+			t.Errorf("Unexpected error for %s: %v", level, err)
+		}
+	}
+}
+
+// transactionCommands returns the commands that control a transaction.
+func transactionCommands(cmds []string) []string {
+	var r []string
+	for _, cmd := range cmds {
+		for _, prefix := range []string{"sSTART", "sCOMMIT", "sROLLBACK", "sSAVEPOINT", "sRELEASE", "sEXEC"} {
+			if strings.HasPrefix(cmd, prefix) {
+				r = append(r, cmd)
+			}
+		}
+	}
+	return r
+}
+
+func TestSavepoints(t *testing.T) {
+	var cmds []string
+	s := newRecordingServer(t, &cmds, nil)
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Error getting connection: %v", err)
+	}
+	defer conn.Close()
+
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	err = conn.Raw(func(driverConn interface{}) error {
+		tx := driverConn.(*Conn).Tx()
+		if err := tx.Savepoint(`before "batch"`); err != nil {
+			return err
+		}
+		if err := tx.RollbackTo(`before "batch"`); err != nil {
+			return err
+		}
+		if err := tx.Release(`before "batch"`); err != nil {
+			return err
+		}
+
+		for _, name := range []string{"", "a\nb", "\xff", strings.Repeat("a", 1025)} {
+			if err := tx.Savepoint(name); err == nil {
+				t.Errorf("Expected an error for savepoint name %q", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	err = conn.Raw(func(driverConn interface{}) error {
+		if tx := driverConn.(*Conn).Tx(); tx != nil {
+			t.Errorf("Transaction is still open after commit")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"sSTART TRANSACTION;",
+		`sSAVEPOINT "before ""batch""";`,
+		`sROLLBACK TO SAVEPOINT "before ""batch""";`,
+		`sRELEASE SAVEPOINT "before ""batch""";`,
+		"sCOMMIT;",
+	}
+	if got := transactionCommands(cmds); strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Invalid commands: %v, expected: %v", got, expected)
+	}
+}
+
+func TestNestedTx(t *testing.T) {
+	var cmds []string
+	s := newRecordingServer(t, &cmds, nil)
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Error getting connection: %v", err)
+	}
+	defer conn.Close()
+
+	outer, err := BeginNested(context.Background(), conn, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	inner, err := outer.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := inner.Tx().Exec("INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := inner.Rollback(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	inner, err = outer.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	innermost, err := inner.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := inner.Commit(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// ending a transaction ends the ones nested in it
+	if err := innermost.Commit(); err != sql.ErrTxDone {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := outer.Commit(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := outer.Begin(); err != sql.ErrTxDone {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"sSTART TRANSACTION;",
+		`sSAVEPOINT "nested_tx_1";`,
+		"sEXEC 3 ();",
+		`sROLLBACK TO SAVEPOINT "nested_tx_1";`,
+		`sRELEASE SAVEPOINT "nested_tx_1";`,
+		`sSAVEPOINT "nested_tx_2";`,
+		`sSAVEPOINT "nested_tx_3";`,
+		`sRELEASE SAVEPOINT "nested_tx_2";`,
+		"sCOMMIT;",
+	}
+	if got := transactionCommands(cmds); strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Invalid commands: %v, expected: %v", got, expected)
+	}
+}
+
+func TestNestedTxSiblings(t *testing.T) {
+	var cmds []string
+	s := newRecordingServer(t, &cmds, nil)
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Error getting connection: %v", err)
+	}
+	defer conn.Close()
+
+	outer, err := BeginNested(context.Background(), conn, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// both are open at the same time, so they need their own savepoints
+	first, err := outer.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, err := outer.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nested, err := second.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := nested.Commit(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := second.Commit(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := first.Rollback(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := outer.Commit(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{
+		"sSTART TRANSACTION;",
+		`sSAVEPOINT "nested_tx_1";`,
+		`sSAVEPOINT "nested_tx_2";`,
+		`sSAVEPOINT "nested_tx_3";`,
+		`sRELEASE SAVEPOINT "nested_tx_3";`,
+		`sRELEASE SAVEPOINT "nested_tx_2";`,
+		`sROLLBACK TO SAVEPOINT "nested_tx_1";`,
+		`sRELEASE SAVEPOINT "nested_tx_1";`,
+		"sCOMMIT;",
+	}
+	if got := transactionCommands(cmds); strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Invalid commands: %v, expected: %v", got, expected)
+	}
+}
+
+// newTransactionServer answers statements that start and end a
+// transaction like the server does, and records all commands.
+func newTransactionServer(t *testing.T, cmds *[]string, rollback string) *fakeServer {
+	prepared := map[string]string{}
+	autoCommit := "t"
+	return newRecordingServer(t, cmds, func(cmd string) (string, bool) {
+		if strings.HasPrefix(cmd, "Xauto_commit ") {
+			// a session without autocommit is always in a transaction
+			if cmd == "Xauto_commit 0" {
+				autoCommit = "f"
+			} else {
+				autoCommit = "t"
+			}
+			return "", true
+		}
+		if strings.HasPrefix(cmd, "sPREPARE ") {
+			id := fmt.Sprintf("%d", len(prepared)+1)
+			prepared["sEXEC "+id+" ();"] = "s" + strings.TrimPrefix(cmd, "sPREPARE ")
+			return fmt.Sprintf("&5 %s 0 6 0\n", id), true
+		}
+		if q, ok := prepared[cmd]; ok {
+			cmd = q
+		}
+
+		switch {
+		case cmd == "sROLLBACK;" && rollback != "":
+			return rollback, true
+		case cmd == "sCOMMIT;" || cmd == "sROLLBACK;":
+			return "&4 " + autoCommit + "\n", true
+		}
+		return recordingResponse(cmd), true
+	})
+}
+
+func TestTransactionState(t *testing.T) {
+	var cmds []string
+	s := newTransactionServer(t, &cmds, "")
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	tx, err := c.BeginTx(context.Background(), driver.TxOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.autoCommit {
+		t.Errorf("Autocommit is on in a transaction")
+	}
+	if _, err := c.BeginTx(context.Background(), driver.TxOptions{}); err == nil {
+		t.Errorf("Expected an error for a nested transaction")
+	}
+
+	// a COMMIT statement ends the transaction on the server
+	if _, err := c.ExecContext(context.Background(), "COMMIT", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !c.autoCommit {
+		t.Errorf("Autocommit is off after the transaction")
+	}
+	if err := tx.Commit(); err == nil || !strings.Contains(err.Error(), "No transaction in progress") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := tx.Rollback(); err != sql.ErrTxDone {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	tx, err = c.BeginTx(context.Background(), driver.TxOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !c.autoCommit || c.Tx() != nil {
+		t.Errorf("Transaction is still open after rollback")
+	}
+
+	// a transaction of a START TRANSACTION statement is not taken over
+	if _, err := c.ExecContext(context.Background(), "START TRANSACTION", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := c.BeginTx(context.Background(), driver.TxOptions{}); err == nil || !strings.Contains(err.Error(), "already in progress") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if c.Tx() != nil {
+		t.Errorf("The transaction was taken over")
+	}
+}
+
+func TestAutoCommitOff(t *testing.T) {
+	var cmds []string
+	s := newTransactionServer(t, &cmds, "")
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn()+"?autocommit=false")
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	if c.autoCommit || count(cmds, "Xauto_commit 0") != 1 {
+		t.Errorf("Autocommit is not turned off: %v", cmds)
+	}
+
+	// the transaction that is open is taken over
+	tx, err := c.BeginTx(context.Background(), driver.TxOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if count(cmds, "sSTART TRANSACTION;") != 0 || count(cmds, "sCOMMIT;") != 1 {
+		t.Errorf("Invalid commands: %v", cmds)
+	}
+
+	_, err = c.BeginTx(context.Background(), driver.TxOptions{Isolation: driver.IsolationLevel(sql.LevelSerializable)})
+	if err == nil {
+		t.Errorf("Expected an error for transaction options")
+	}
+}
+
+func TestResetSession(t *testing.T) {
+	var cmds []string
+	s := newTransactionServer(t, &cmds, "")
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn())
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// a transaction that is started with a statement is left open
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatalf("Error getting connection: %v", err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "START TRANSACTION"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	conn.Close()
+
+	if _, err := db.Exec("UPDATE t SET a = 1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if count(cmds, "sROLLBACK;") != 1 {
+		t.Errorf("The open transaction was not rolled back: %v", cmds)
+	}
+}
+
+func TestResetSessionAutoCommitOff(t *testing.T) {
+	var cmds []string
+	s := newTransactionServer(t, &cmds, "")
+	defer s.Close()
+
+	db, err := sql.Open("monetdb", s.dsn()+"?autocommit=off")
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// a statement that is not committed before the connection is
+	// returned to the pool
+	if _, err := db.Exec("UPDATE t SET a = 1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []string{"sUPDATE t SET a = 1;", "sROLLBACK;", "sCOMMIT;"}
+	var got []string
+	for _, cmd := range cmds {
+		if cmd == "sROLLBACK;" || cmd == "sCOMMIT;" || strings.HasPrefix(cmd, "sPREPARE ") {
+			got = append(got, strings.Replace(cmd, "sPREPARE ", "s", 1))
+		}
+	}
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Invalid commands: %v, expected: %v", got, expected)
+	}
+}
+
+func TestResetSessionFailure(t *testing.T) {
+	var cmds []string
+	s := newTransactionServer(t, &cmds, "!25000!ROLLBACK: failed\n")
+	defer s.Close()
+
+	c, err := openTestConn(t, s.dsn())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.ResetSession(context.Background()); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := c.BeginTx(context.Background(), driver.TxOptions{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := c.ResetSession(context.Background()); err != driver.ErrBadConn {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}